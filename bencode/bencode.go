@@ -2,8 +2,14 @@ package bencode
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
+	"fmt"
 	"io"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
 )
 
 var (
@@ -13,6 +19,12 @@ var (
 	ErrEpE = errors.New("expect char e")
 	ErrTyp = errors.New("wrong type")
 	ErrIvd = errors.New("invalid bencode")
+	// 整数不能为空，不能有前导0，也不能是-0
+	ErrInt      = errors.New("malformed integer")
+	ErrOverflow = errors.New("integer overflow")
+	// 严格模式下dict的key必须按原始byte排序并且不能重复
+	ErrKeyOrder = errors.New("dict keys not sorted")
+	ErrKeyDup   = errors.New("duplicate dict key")
 )
 
 type BType uint8
@@ -31,18 +43,62 @@ type BObject struct {
 	val_  BValue
 }
 
+func (o *BObject) Type() BType {
+	return o.type_
+}
+
+// 字符串以[]byte保存，Str返回的是一份拷贝
 func (o *BObject) Str() (string, error) {
 	if o.type_ != BSTR {
 		return "", ErrTyp
 	}
-	return o.val_.(string), nil
+	return string(o.val_.([]byte)), nil
+}
+
+// 不拷贝，直接返回字符串的内容，ParseBytes解析出来的值引用的是输入的buffer，不能修改
+func (o *BObject) Bytes() ([]byte, error) {
+	if o.type_ != BSTR {
+		return nil, ErrTyp
+	}
+	return o.val_.([]byte), nil
 }
 
+// 超出int范围时返回ErrOverflow
 func (o *BObject) Int() (int, error) {
+	val, err := o.Int64()
+	if err != nil {
+		return 0, err
+	}
+	if int64(int(val)) != val {
+		return 0, ErrOverflow
+	}
+	return int(val), nil
+}
+
+// 超出int64范围的整数以*big.Int保存，此时返回ErrOverflow，需要通过BigInt读取
+func (o *BObject) Int64() (int64, error) {
 	if o.type_ != BINT {
 		return 0, ErrTyp
 	}
-	return o.val_.(int), nil
+	val, ok := o.val_.(int64)
+	if !ok {
+		return 0, ErrOverflow
+	}
+	return val, nil
+}
+
+// 任意大小的整数都可以读取，返回的是一份拷贝
+func (o *BObject) BigInt() (*big.Int, error) {
+	if o.type_ != BINT {
+		return nil, ErrTyp
+	}
+	switch val := o.val_.(type) {
+	case int64:
+		return big.NewInt(val), nil
+	case *big.Int:
+		return new(big.Int).Set(val), nil
+	}
+	return nil, ErrTyp
 }
 
 func (o *BObject) List() ([]*BObject, error) {
@@ -59,7 +115,98 @@ func (o *BObject) Dict() (map[string]*BObject, error) {
 	return o.val_.(map[string]*BObject), nil
 }
 
-func (o *BObject) Bencode(w io.Writer) int {
+// 按路径取出内层的值，路径的格式和SyntaxError中的相同，例如info.files[3].length
+func (o *BObject) Lookup(path string) (*BObject, error) {
+	cur := o
+	for i := 0; i < len(path); {
+		switch path[i] {
+		case '.':
+			i++
+		case '[':
+			end := strings.IndexByte(path[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("bad path %q", path)
+			}
+			idx, err := strconv.Atoi(path[i+1 : i+end])
+			if err != nil {
+				return nil, fmt.Errorf("bad path %q", path)
+			}
+			list, err := cur.List()
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", path[:i], err)
+			}
+			if idx < 0 || idx >= len(list) {
+				return nil, fmt.Errorf("%s: index %d out of range", path[:i], idx)
+			}
+			cur = list[idx]
+			i += end + 1
+		default:
+			end := strings.IndexAny(path[i:], ".[")
+			if end < 0 {
+				end = len(path) - i
+			}
+			key := path[i : i+end]
+			dict, err := cur.Dict()
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", path[:i], err)
+			}
+			if cur = dict[key]; cur == nil {
+				return nil, fmt.Errorf("%s: key %q not found", path[:i], key)
+			}
+			i += end
+		}
+	}
+	return cur, nil
+}
+
+// 用于错误信息
+func (o *BObject) typeName() string {
+	switch o.type_ {
+	case BSTR:
+		return "string"
+	case BINT:
+		return "int"
+	case BLIST:
+		return "list"
+	case BDICT:
+		return "dict"
+	}
+	return "unknown"
+}
+
+// 转为由string、int64、[]interface{}和map[string]interface{}组成的值
+func (o *BObject) generic() interface{} {
+	switch o.type_ {
+	case BSTR:
+		str, _ := o.Str()
+		return str
+	case BINT:
+		// 超出int64范围时是*big.Int
+		if val, ok := o.val_.(*big.Int); ok {
+			return new(big.Int).Set(val)
+		}
+		val, _ := o.Int64()
+		return val
+	case BLIST:
+		list, _ := o.List()
+		ret := make([]interface{}, len(list))
+		for i, elem := range list {
+			ret[i] = elem.generic()
+		}
+		return ret
+	case BDICT:
+		dict, _ := o.Dict()
+		ret := make(map[string]interface{}, len(dict))
+		for k, elem := range dict {
+			ret[k] = elem.generic()
+		}
+		return ret
+	}
+	return nil
+}
+
+// 返回写入的字节数，写入失败时返回错误
+func (o *BObject) Bencode(w io.Writer) (int, error) {
 	bw, ok := w.(*bufio.Writer)
 	if !ok {
 		bw = bufio.NewWriter(w)
@@ -68,94 +215,102 @@ func (o *BObject) Bencode(w io.Writer) int {
 	wLen := 0
 	switch o.type_ {
 	case BSTR:
-		str, _ := o.Str()
-		wLen += EncodeString(bw, str)
+		str, _ := o.Bytes()
+		wLen += writeDecimal(bw, len(str))
+		bw.WriteByte(':')
+		bw.Write(str)
+		wLen += len(str) + 1
 	case BINT:
-		val, _ := o.Int()
-		wLen += EncodeInt(bw, val)
+		num := o.intString()
+		bw.WriteByte('i')
+		bw.WriteString(num)
+		bw.WriteByte('e')
+		wLen += len(num) + 2
 	case BLIST:
 		bw.WriteByte('l')
 		list, _ := o.List()
 		for _, elem := range list {
-			wLen += elem.Bencode(bw)
+			n, err := elem.Bencode(bw)
+			wLen += n
+			if err != nil {
+				return wLen, err
+			}
 		}
 		bw.WriteByte('e')
 		wLen += 2
 	case BDICT:
 		bw.WriteByte('d')
 		dict, _ := o.Dict()
-		for k, v := range dict {
-			wLen += EncodeString(bw, k)
-			wLen += v.Bencode(bw)
+		// 规范的bencode要求key按原始byte排序，否则同一个dict每次编码的结果不同，info hash也不同
+		for _, k := range sortedKeys(dict) {
+			n, err := EncodeString(bw, k)
+			wLen += n
+			if err != nil {
+				return wLen, err
+			}
+			n, err = dict[k].Bencode(bw)
+			wLen += n
+			if err != nil {
+				return wLen, err
+			}
 		}
 		bw.WriteByte('e')
 		wLen += 2
 	}
-	bw.Flush()
-	return wLen
+	if err := bw.Flush(); err != nil {
+		return 0, err
+	}
+	return wLen, nil
+}
+
+// dict的key按原始byte排序，go中string的比较就是按byte比较
+func sortedKeys(dict map[string]*BObject) []string {
+	keys := make([]string, 0, len(dict))
+	for k := range dict {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
 }
 
 func checkNum(data byte) bool {
 	return data >= '0' && data <= '9'
 }
 
-func readDecimal(r *bufio.Reader) (val int, len int) {
-	sign := 1
-	b, _ := r.ReadByte()
-	len++
-
-	if b == '-' {
-		sign = -1
-		b, _ = r.ReadByte()
-		len++
-	}
-
+// 读取连续的数字，遇到第一个不是数字的byte时停止，该byte不会被消耗
+func readDigits(r *bufio.Reader) []byte {
+	var digits []byte
 	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return digits
+		}
 		if !checkNum(b) {
 			r.UnreadByte()
-			len--
-			return sign * val, len
+			return digits
 		}
-		val = val*10 + int(b-'0')
-		b, _ = r.ReadByte()
-		len++
+		digits = append(digits, b)
 	}
 }
 
-func writeDecimal(w *bufio.Writer, val int) (len int) {
-	if val == 0 {
-		w.WriteByte('0')
-		len++
-		return
-	}
-
-	if val < 0 {
-		w.WriteByte('-')
-		len++
-		val *= -1
+// 整数的十进制表示，超出int64范围的整数以*big.Int保存
+func (o *BObject) intString() string {
+	switch val := o.val_.(type) {
+	case int64:
+		return strconv.FormatInt(val, 10)
+	case *big.Int:
+		return val.String()
 	}
+	return ""
+}
 
-	dividend := 1
-	for {
-		if dividend > val {
-			dividend /= 10
-			break
-		}
-		dividend *= 10
-	}
-	for {
-		num := byte(val / dividend)
-		w.WriteByte('0' + num)
-		len++
-		if dividend == 1 {
-			return
-		}
-		val %= dividend
-		dividend /= 10
-	}
+func writeDecimal(w *bufio.Writer, val int) int {
+	num := strconv.Itoa(val)
+	w.WriteString(num)
+	return len(num)
 }
 
-func EncodeString(w io.Writer, val string) int {
+func EncodeString(w io.Writer, val string) (int, error) {
 	strLen := len(val)
 	bw := bufio.NewWriter(w)
 	wLen := writeDecimal(bw, strLen)
@@ -166,9 +321,9 @@ func EncodeString(w io.Writer, val string) int {
 
 	err := bw.Flush()
 	if err != nil {
-		return 0
+		return 0, err
 	}
-	return wLen
+	return wLen, nil
 }
 
 func DecodeString(r io.Reader) (val string, err error) {
@@ -176,21 +331,55 @@ func DecodeString(r io.Reader) (val string, err error) {
 	if !ok {
 		br = bufio.NewReader(r)
 	}
-	num, wLen := readDecimal(br)
-	if wLen == 0 {
-		return val, ErrNum
+	val, _, err = decodeString(br, 0)
+	return
+}
+
+// maxLen大于0时，在分配内存之前检查字符串长度
+// n是已经消耗的byte数，出错时也会返回，用于计算错误的位置
+func decodeString(br *bufio.Reader, maxLen int) (val string, n int, err error) {
+	buf, n, err := decodeBytes(br, maxLen)
+	return string(buf), n, err
+}
+
+func decodeBytes(br *bufio.Reader, maxLen int) (val []byte, n int, err error) {
+	// 长度只能是数字，负数的长度也会在这里被拒绝
+	digits := readDigits(br)
+	n = len(digits)
+	if n == 0 {
+		return val, n, ErrNum
+	}
+	num, err := strconv.Atoi(string(digits))
+	if err != nil {
+		return val, n, ErrStrLen
+	}
+	if maxLen > 0 && num > maxLen {
+		return val, n, ErrStrLen
 	}
 	b, err := br.ReadByte()
+	if err != nil {
+		return val, n, io.ErrUnexpectedEOF
+	}
 	if b != ':' {
-		return val, ErrCol
+		return val, n, ErrCol
 	}
-	buf := make([]byte, num)
-	_, err = io.ReadAtLeast(br, buf, num)
-	val = string(buf)
+	n++
+	// 长度只是输入中声明的值，不能直接按其分配内存，随着读到的数据逐步增长
+	size := num
+	if size > 64<<10 {
+		size = 64 << 10
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, size))
+	m, err := io.CopyN(buf, br, int64(num))
+	n += int(m)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	val = buf.Bytes()
 	return
 }
 
-func EncodeInt(w io.Writer, val int) int {
+func EncodeInt(w io.Writer, val int) (int, error) {
 	bw := bufio.NewWriter(w)
 	wLen := 0
 	bw.WriteByte('i')
@@ -202,9 +391,9 @@ func EncodeInt(w io.Writer, val int) int {
 
 	err := bw.Flush()
 	if err != nil {
-		return 0
+		return 0, err
 	}
-	return wLen
+	return wLen, nil
 }
 
 func DecodeInt(r io.Reader) (val int, err error) {
@@ -212,14 +401,65 @@ func DecodeInt(r io.Reader) (val int, err error) {
 	if !ok {
 		br = bufio.NewReader(r)
 	}
+	o, _, err := decodeInt(br)
+	if err != nil {
+		return 0, err
+	}
+	return o.Int()
+}
+
+// 返回BINT类型的BObject，超出int64范围时以*big.Int保存
+// n是已经消耗的byte数，出错时也会返回，用于计算错误的位置
+func decodeInt(br *bufio.Reader) (o *BObject, n int, err error) {
 	b, err := br.ReadByte()
+	if err != nil {
+		return nil, n, io.ErrUnexpectedEOF
+	}
 	if b != 'i' {
-		return val, ErrEpI
+		return nil, n, ErrEpI
+	}
+	n++
+	neg := false
+	if p, err := br.Peek(1); err == nil && p[0] == '-' {
+		br.ReadByte()
+		n++
+		neg = true
+	}
+	digits := readDigits(br)
+	n += len(digits)
+	if err := checkInt(neg, digits); err != nil {
+		return nil, n, err
 	}
-	val, _ = readDecimal(br)
 	b, err = br.ReadByte()
+	if err != nil {
+		return nil, n, io.ErrUnexpectedEOF
+	}
 	if b != 'e' {
-		return val, ErrEpE
+		return nil, n, ErrEpE
 	}
-	return
+	n++
+	return newInt(neg, digits), n, nil
+}
+
+// digits已经检查过格式，超出int64范围时以*big.Int保存
+func newInt(neg bool, digits []byte) *BObject {
+	num := string(digits)
+	if neg {
+		num = "-" + num
+	}
+	o := &BObject{type_: BINT}
+	if val, err := strconv.ParseInt(num, 10, 64); err == nil {
+		o.val_ = val
+	} else {
+		o.val_, _ = new(big.Int).SetString(num, 10)
+	}
+	return o
+}
+
+// ie、i-e、i03e和i-0e都是不合法的
+func checkInt(neg bool, digits []byte) error {
+	if len(digits) == 0 || digits[0] == '0' && (len(digits) > 1 || neg) {
+		return ErrInt
+	}
+	return nil
 }
@@ -2,6 +2,8 @@ package bencode
 
 import (
 	"bytes"
+	"io"
+	"math"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -10,7 +12,8 @@ import (
 func TestString(t *testing.T) {
 	val := "abc"
 	buf := new(bytes.Buffer)
-	wLen := EncodeString(buf, val)
+	wLen, err := EncodeString(buf, val)
+	assert.Equal(t, nil, err)
 	assert.Equal(t, 5, wLen)
 	str, _ := DecodeString(buf)
 	assert.Equal(t, val, str)
@@ -20,7 +23,8 @@ func TestString(t *testing.T) {
 		val += string(byte('a' + i))
 	}
 	buf.Reset()
-	wLen = EncodeString(buf, val)
+	wLen, err = EncodeString(buf, val)
+	assert.Equal(t, nil, err)
 	assert.Equal(t, 23, wLen)
 	str, _ = DecodeString(buf)
 	assert.Equal(t, val, str)
@@ -29,22 +33,90 @@ func TestString(t *testing.T) {
 func TestInt(t *testing.T) {
 	val := 999
 	buf := new(bytes.Buffer)
-	wLen := EncodeInt(buf, val)
+	wLen, err := EncodeInt(buf, val)
+	assert.Equal(t, nil, err)
 	assert.Equal(t, 5, wLen)
 	iv, _ := DecodeInt(buf)
 	assert.Equal(t, val, iv)
 
 	val = 0
 	buf.Reset()
-	wLen = EncodeInt(buf, val)
+	wLen, err = EncodeInt(buf, val)
+	assert.Equal(t, nil, err)
 	assert.Equal(t, 3, wLen)
 	iv, _ = DecodeInt(buf)
 	assert.Equal(t, val, iv)
 
 	val = -99
 	buf.Reset()
-	wLen = EncodeInt(buf, val)
+	wLen, err = EncodeInt(buf, val)
+	assert.Equal(t, nil, err)
 	assert.Equal(t, 5, wLen)
 	iv, _ = DecodeInt(buf)
 	assert.Equal(t, val, iv)
 }
+
+func TestEncodeWriteError(t *testing.T) {
+	_, err := EncodeString(failWriter{}, "abc")
+	assert.Equal(t, io.ErrClosedPipe, err)
+	_, err = EncodeInt(failWriter{}, 1)
+	assert.Equal(t, io.ErrClosedPipe, err)
+
+	o, err := ParseBytes([]byte("d1:ali1ee1:b1:xe"))
+	assert.Equal(t, nil, err)
+	_, err = o.Bencode(failWriter{})
+	assert.Equal(t, io.ErrClosedPipe, err)
+}
+
+func TestIntStrict(t *testing.T) {
+	for _, in := range []string{"ie", "i-e", "i03e", "i-0e", "i00e", "i-01e"} {
+		_, err := DecodeInt(bytes.NewBufferString(in))
+		assert.Equal(t, ErrInt, err, in)
+	}
+	_, err := DecodeInt(bytes.NewBufferString("i12"))
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	_, err = DecodeInt(bytes.NewBufferString("i1x"))
+	assert.Equal(t, ErrEpE, err)
+
+	val, err := DecodeInt(bytes.NewBufferString("i-9223372036854775808e"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, math.MinInt64, val)
+	_, err = DecodeInt(bytes.NewBufferString("i9223372036854775808e"))
+	assert.Equal(t, ErrOverflow, err)
+}
+
+func TestStringLength(t *testing.T) {
+	// 负数的长度和缺少长度都是错误
+	_, err := DecodeString(bytes.NewBufferString("-1:a"))
+	assert.Equal(t, ErrNum, err)
+	_, err = DecodeString(bytes.NewBufferString(":a"))
+	assert.Equal(t, ErrNum, err)
+	_, err = DecodeString(bytes.NewBufferString("99999999999999999999:a"))
+	assert.Equal(t, ErrStrLen, err)
+	// 声明的长度超过实际的数据
+	_, err = DecodeString(bytes.NewBufferString("1000000000:abc"))
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+}
+
+func TestBigInt(t *testing.T) {
+	in := "i-123456789012345678901234567890e"
+	o, err := Parse(bytes.NewBufferString(in))
+	assert.Equal(t, nil, err)
+	_, err = o.Int64()
+	assert.Equal(t, ErrOverflow, err)
+	b, err := o.BigInt()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "-123456789012345678901234567890", b.String())
+
+	buf := new(bytes.Buffer)
+	n, err := o.Bencode(buf)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, len(in), n)
+	assert.Equal(t, in, buf.String())
+
+	o, err = Parse(bytes.NewBufferString("i9223372036854775807e"))
+	assert.Equal(t, nil, err)
+	v, err := o.Int64()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, int64(math.MaxInt64), v)
+}
@@ -0,0 +1,142 @@
+package bencode
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"strings"
+	"unicode/utf8"
+)
+
+// ToJSON中不是UTF-8的字符串的编码方式
+type BinaryEncoding int
+
+const (
+	BinaryHex BinaryEncoding = iota
+	BinaryBase64
+)
+
+// 编码之后的字符串带上前缀，FromJSON根据前缀还原，本身以前缀开头的字符串也会被编码，保证可以还原
+const (
+	hexPrefix    = "hex:"
+	base64Prefix = "base64:"
+)
+
+var ErrJSON = errors.New("cannot convert json to bencode")
+
+// 将o转为JSON，整数转为number，list转为array，dict转为object
+// 不是UTF-8的字符串(比如pieces和compact的peers)按enc编码为"hex:..."或者"base64:..."
+func ToJSON(o *BObject, enc BinaryEncoding) ([]byte, error) {
+	return json.Marshal(toJSONValue(o, enc))
+}
+
+func jsonString(b []byte, enc BinaryEncoding) string {
+	if utf8.Valid(b) && !bytes.HasPrefix(b, []byte(hexPrefix)) && !bytes.HasPrefix(b, []byte(base64Prefix)) {
+		return string(b)
+	}
+	if enc == BinaryBase64 {
+		return base64Prefix + base64.StdEncoding.EncodeToString(b)
+	}
+	return hexPrefix + hex.EncodeToString(b)
+}
+
+func toJSONValue(o *BObject, enc BinaryEncoding) interface{} {
+	switch o.type_ {
+	case BSTR:
+		str, _ := o.Bytes()
+		return jsonString(str, enc)
+	case BINT:
+		return json.Number(o.intString())
+	case BLIST:
+		list, _ := o.List()
+		ret := make([]interface{}, len(list))
+		for i, elem := range list {
+			ret[i] = toJSONValue(elem, enc)
+		}
+		return ret
+	case BDICT:
+		dict, _ := o.Dict()
+		ret := make(map[string]interface{}, len(dict))
+		for k, elem := range dict {
+			ret[jsonString([]byte(k), enc)] = toJSONValue(elem, enc)
+		}
+		return ret
+	}
+	return nil
+}
+
+// ToJSON的逆过程，"hex:"和"base64:"开头的字符串被还原为原始的byte
+// JSON中的bool、null和小数在bencode中没有对应的值，返回ErrJSON
+func FromJSON(data []byte) (*BObject, error) {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	// More在遇到]或}时也返回false，要读到io.EOF才能确认后面没有其他数据
+	if _, err := d.Token(); err != io.EOF {
+		return nil, fmt.Errorf("%w: trailing data", ErrJSON)
+	}
+	return fromJSONValue(v)
+}
+
+func fromJSONString(str string) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(str, hexPrefix):
+		return hex.DecodeString(str[len(hexPrefix):])
+	case strings.HasPrefix(str, base64Prefix):
+		return base64.StdEncoding.DecodeString(str[len(base64Prefix):])
+	}
+	return []byte(str), nil
+}
+
+func fromJSONValue(v interface{}) (*BObject, error) {
+	switch val := v.(type) {
+	case string:
+		str, err := fromJSONString(val)
+		if err != nil {
+			return nil, err
+		}
+		return &BObject{type_: BSTR, val_: str}, nil
+	case json.Number:
+		// 只接受整数，checkInt同样拒绝前导0和-0
+		num := string(val)
+		neg := strings.HasPrefix(num, "-")
+		digits := []byte(strings.TrimPrefix(num, "-"))
+		if _, ok := new(big.Int).SetString(num, 10); !ok || checkInt(neg, digits) != nil {
+			return nil, fmt.Errorf("%w: %s is not an integer", ErrJSON, num)
+		}
+		return newInt(neg, digits), nil
+	case []interface{}:
+		list := make([]*BObject, len(val))
+		for i, elem := range val {
+			o, err := fromJSONValue(elem)
+			if err != nil {
+				return nil, err
+			}
+			list[i] = o
+		}
+		return &BObject{type_: BLIST, val_: list}, nil
+	case map[string]interface{}:
+		dict := make(map[string]*BObject, len(val))
+		for k, elem := range val {
+			key, err := fromJSONString(k)
+			if err != nil {
+				return nil, err
+			}
+			o, err := fromJSONValue(elem)
+			if err != nil {
+				return nil, err
+			}
+			dict[string(key)] = o
+		}
+		return &BObject{type_: BDICT, val_: dict}, nil
+	}
+	return nil, fmt.Errorf("%w: unsupported value %v", ErrJSON, v)
+}
@@ -0,0 +1,87 @@
+package bencode
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestToJSON(t *testing.T) {
+	in := "d8:announce3:url4:infod6:lengthi3e4:name3:a.b6:pieces4:\xff\x00\x01\x02e5:tracki-1ee"
+	o, err := Parse(bytes.NewBufferString(in))
+	assert.Equal(t, nil, err)
+
+	js, err := ToJSON(o, BinaryHex)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, `{"announce":"url","info":{"length":3,"name":"a.b","pieces":"hex:ff000102"},"track":-1}`, string(js))
+
+	js, err = ToJSON(o, BinaryBase64)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, `{"announce":"url","info":{"length":3,"name":"a.b","pieces":"base64:/wABAg=="},"track":-1}`, string(js))
+
+	// 两种编码都可以还原
+	back, err := FromJSON(js)
+	assert.Equal(t, nil, err)
+	buf := new(bytes.Buffer)
+	_, err = back.Bencode(buf)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, in, buf.String())
+}
+
+func TestJSONRoundTrip(t *testing.T) {
+	for _, in := range []string{
+		// 本身以前缀开头的字符串，二进制的key和超出int64的整数
+		"l4:hex:7:base64:e",
+		"d20:\x01\x02\x03\x04\x05\x06\x07\x08\x09\x0a\x0b\x0c\x0d\x0e\x0f\x10\x11\x12\x13\x14d8:completei5eee",
+		"i123456789012345678901234567890e",
+		"le", "de", "0:",
+	} {
+		o, err := ParseBytes([]byte(in))
+		assert.Equal(t, nil, err, in)
+		js, err := ToJSON(o, BinaryHex)
+		assert.Equal(t, nil, err, in)
+		back, err := FromJSON(js)
+		assert.Equal(t, nil, err, in)
+		buf := new(bytes.Buffer)
+		_, err = back.Bencode(buf)
+		assert.Equal(t, nil, err, in)
+		assert.Equal(t, in, buf.String(), string(js))
+	}
+}
+
+func TestFromJSONError(t *testing.T) {
+	for _, js := range []string{`1.5`, `1e3`, `-0`, `true`, `null`, `{"a":[false]}`, `1 2`, `{"a":1}]`, `[1]}`, `"a" "b"`} {
+		_, err := FromJSON([]byte(js))
+		assert.True(t, errors.Is(err, ErrJSON), js)
+	}
+	_, err := FromJSON([]byte(`"hex:zz"`))
+	assert.NotEqual(t, nil, err)
+	_, err = FromJSON([]byte(`{"a":`))
+	assert.NotEqual(t, nil, err)
+	// 结尾的空白不是多余的数据
+	_, err = FromJSON([]byte("{\"a\":1}\n"))
+	assert.Equal(t, nil, err)
+}
+
+func TestLookup(t *testing.T) {
+	o, err := Parse(bytes.NewBufferString("d4:infod5:filesld6:lengthi1eed6:lengthi2eeeee"))
+	assert.Equal(t, nil, err)
+	v, err := o.Lookup("info.files[1].length")
+	assert.Equal(t, nil, err)
+	objAssertInt(t, 2, v)
+
+	v, err = o.Lookup("")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, o, v)
+
+	_, err = o.Lookup("info.files[2]")
+	assert.NotEqual(t, nil, err)
+	_, err = o.Lookup("info.name")
+	assert.NotEqual(t, nil, err)
+	_, err = o.Lookup("info[0]")
+	assert.True(t, errors.Is(err, ErrTyp))
+	_, err = o.Lookup("info.files[x]")
+	assert.NotEqual(t, nil, err)
+}
@@ -1,278 +1,626 @@
 package bencode
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
 	"io"
+	"math/big"
 	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 )
 
-// 将torrent格式的字符串转为go中的slice或struct，可以灵活处理不同类型的slice和struct
-func Unmarshal(r io.Reader, s interface{}) error {
-	o, err := Parse(r)
-	if err != nil {
+// 实现了Marshaler的类型自己决定如何编码，返回的必须是一个完整的bencode值
+type Marshaler interface {
+	MarshalBencode() ([]byte, error)
+}
+
+// 实现了Unmarshaler的类型自己决定如何解码，传入的是该值完整的bencode编码
+// 需要修改接收者，因此一般实现在指针上
+type Unmarshaler interface {
+	UnmarshalBencode([]byte) error
+}
+
+var (
+	ErrUnsupported = errors.New("unsupported type")
+	ErrNil         = errors.New("cannot encode nil value")
+	ErrRequired    = errors.New("missing required key")
+)
+
+var (
+	bigIntType      = reflect.TypeOf(big.Int{})
+	marshalerType   = reflect.TypeOf((*Marshaler)(nil)).Elem()
+	unmarshalerType = reflect.TypeOf((*Unmarshaler)(nil)).Elem()
+)
+
+// v实现了Marshaler时返回它，值接收者和可以取地址的指针接收者都可以
+func marshaler(v reflect.Value) (Marshaler, bool) {
+	// 没有导出的field无法调用其方法
+	if !v.IsValid() || !v.CanInterface() {
+		return nil, false
+	}
+	if v.Type().Implements(marshalerType) {
+		if v.Kind() == reflect.Ptr && v.IsNil() {
+			return nil, false
+		}
+		return v.Interface().(Marshaler), true
+	}
+	if v.CanAddr() && reflect.PtrTo(v.Type()).Implements(marshalerType) {
+		return v.Addr().Interface().(Marshaler), true
+	}
+	return nil, false
+}
+
+// v实现了Unmarshaler时返回它，v是nil指针时先为其分配
+func unmarshaler(v reflect.Value) (Unmarshaler, bool) {
+	if v.Kind() == reflect.Ptr && v.Type().Implements(unmarshalerType) {
+		if v.IsNil() {
+			if !v.CanSet() {
+				return nil, false
+			}
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return v.Interface().(Unmarshaler), true
+	}
+	if v.CanAddr() && reflect.PtrTo(v.Type()).Implements(unmarshalerType) {
+		return v.Addr().Interface().(Unmarshaler), true
+	}
+	return nil, false
+}
+
+// 将o重新编码之后交给u解码
+func unmarshalCustom(u Unmarshaler, o *BObject) error {
+	buf := new(bytes.Buffer)
+	if _, err := o.Bencode(buf); err != nil {
 		return err
 	}
+	return u.UnmarshalBencode(buf.Bytes())
+}
+
+// 将torrent格式的字符串转为go中的值，s必须是指针，可以指向struct、slice、map、string和各种整数
+// 指向interface{}时写入由string、int64、[]interface{}和map[string]interface{}组成的值，不需要预先定义struct
+func Unmarshal(r io.Reader, s interface{}) error {
+	return NewDecoder(r).Decode(s)
+}
+
+// 将Parse得到的o写入s
+func unmarshalObject(o *BObject, s interface{}) error {
 	p := reflect.ValueOf(s)
 
-	if p.Kind() != reflect.Ptr {
+	if p.Kind() != reflect.Ptr || p.IsNil() {
 		return errors.New("dest must be a pointer")
 	}
 
-	// 通过Parse解析文本，看其是什么类型
+	// *BObject直接得到解析的结果
+	if po, ok := s.(*BObject); ok {
+		*po = *o
+		return nil
+	}
+	return unmarshalValue(p.Elem(), o)
+}
+
+// o的类型和v的类型不匹配
+func typeErr(o *BObject, t reflect.Type) error {
+	return fmt.Errorf("%w: cannot decode %s into %v", ErrTyp, o.typeName(), t)
+}
+
+// 根据v的类型将o写入v，v必须是可以set的
+func unmarshalValue(v reflect.Value, o *BObject) error {
+	if u, ok := unmarshaler(v); ok {
+		return unmarshalCustom(u, o)
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr:
+		// nil指针先分配，再写入其指向的值
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return unmarshalValue(v.Elem(), o)
+	case reflect.Interface:
+		// 只支持空接口，写入string、int64、[]interface{}和map[string]interface{}组成的值
+		if v.NumMethod() != 0 {
+			return fmt.Errorf("%w: %v", ErrUnsupported, v.Type())
+		}
+		v.Set(reflect.ValueOf(o.generic()))
+		return nil
+	case reflect.Float32, reflect.Float64, reflect.Complex64, reflect.Complex128,
+		reflect.Chan, reflect.Func, reflect.UnsafePointer:
+		// bencode中没有能对应这些类型的值
+		return fmt.Errorf("%w: %v", ErrUnsupported, v.Type())
+	}
+
 	switch o.type_ {
+	case BSTR:
+		// o的内容可能引用ParseBytes的输入，写入v时都需要拷贝
+		val, _ := o.Bytes()
+		switch {
+		case v.Kind() == reflect.String:
+			v.SetString(string(val))
+		case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+			v.SetBytes(append([]byte{}, val...))
+		case v.Kind() == reflect.Array && v.Type().Elem().Kind() == reflect.Uint8:
+			// [20]byte这样的定长数组，长度必须完全相同
+			if len(val) != v.Len() {
+				return fmt.Errorf("%w: cannot decode %d bytes into %v", ErrTyp, len(val), v.Type())
+			}
+			reflect.Copy(v, reflect.ValueOf(val))
+		default:
+			return typeErr(o, v.Type())
+		}
+	case BINT:
+		return setInt(v, o)
 	case BLIST:
-		// 转成该格式
-		// []*BObject
 		list, _ := o.List()
-		// 看传入的s是什么类型，创建一个和其类型相同的slice，长度为Parse解析出来的list的长度
-		l := reflect.MakeSlice(p.Elem().Type(), len(list), len(list))
-		// 将传入的s的指针指向新创建的slice，后续只要根据index设置相应值即可
-		// 虽然传进来的是一个空的slice，但是在反射中做append是非常麻烦的，而且slice可能长度不为空或者与list的长度不匹配
-		// 因此直接将其指针指向新分配的slice即可
-		p.Elem().Set(l)
-		err = unmarshalList(p, list)
-		if err != nil {
-			return err
-		}
+		return unmarshalList(v, list, o)
 	case BDICT:
-		// 如果是一个指向struct的指针，不用像slice那么麻烦，直接set相应的filed即可
-		// 如果Parse解析出来的是Dict，根据Dict的key和value设置struct中相应的属性即可
 		dict, _ := o.Dict()
-		err = unmarshalDict(p, dict)
-		if err != nil {
-			return err
+		return unmarshalDict(v, dict, o)
+	}
+	return nil
+}
+
+// 整数写入各种宽度的int、uint和bool，超出范围时返回ErrOverflow
+func setInt(v reflect.Value, o *BObject) error {
+	if v.Type() == bigIntType {
+		val, _ := o.BigInt()
+		v.Set(reflect.ValueOf(val).Elem())
+		return nil
+	}
+	val, err := o.Int64()
+	if err != nil {
+		// 超出int64范围的整数只有uint64可能放得下
+		b, _ := o.BigInt()
+		if v.Kind() == reflect.Uint64 && b.IsUint64() {
+			v.SetUint(b.Uint64())
+			return nil
 		}
+		return fmt.Errorf("%w: %v overflows %v", ErrOverflow, b, v.Type())
+	}
+
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if v.OverflowInt(val) {
+			return fmt.Errorf("%w: %d overflows %v", ErrOverflow, val, v.Type())
+		}
+		v.SetInt(val)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if val < 0 || v.OverflowUint(uint64(val)) {
+			return fmt.Errorf("%w: %d overflows %v", ErrOverflow, val, v.Type())
+		}
+		v.SetUint(uint64(val))
+	case reflect.Bool:
+		// bencode没有bool类型，约定用i0e和i1e表示
+		if val != 0 && val != 1 {
+			return fmt.Errorf("%w: %d is not a bool", ErrTyp, val)
+		}
+		v.SetBool(val == 1)
 	default:
-		return errors.New("src code must be struct or slice")
+		return typeErr(o, v.Type())
 	}
 	return nil
 }
 
-// p.Kind must be Ptr && p.Elem().Type().Kind() must be Slice
-func unmarshalList(p reflect.Value, list []*BObject) error {
-	if p.Kind() != reflect.Ptr || p.Elem().Type().Kind() != reflect.Slice {
-		return errors.New("dest must be pointer to slice")
+// v的类型必须是slice或者array
+func unmarshalList(v reflect.Value, list []*BObject, o *BObject) error {
+	switch v.Kind() {
+	case reflect.Slice:
+		// 看传入的v是什么类型，创建一个和其类型相同的slice，长度为Parse解析出来的list的长度
+		// 虽然传进来的可能是一个空的slice，但是在反射中做append是非常麻烦的，而且slice可能长度不为空或者与list的长度不匹配
+		// 因此直接将v设置为新分配的slice即可
+		v.Set(reflect.MakeSlice(v.Type(), len(list), len(list)))
+	case reflect.Array:
+		if len(list) != v.Len() {
+			return fmt.Errorf("%w: cannot decode list of %d into %v", ErrTyp, len(list), v.Type())
+		}
+	default:
+		return typeErr(o, v.Type())
 	}
 
 	// 长度就是新创建的slice的长度，根据index去填每个位置的数即可
-	v := p.Elem()
-
-	if len(list) == 0 {
-		return nil
+	for i, elem := range list {
+		err := unmarshalValue(v.Index(i), elem)
+		if err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	// 根据第一个元素的类型来确定list的类型，list中所有元素的类型都是相同的
-	switch list[0].type_ {
-	case BSTR:
-		// 取出list中的每个元素，依次设置在v中相应的index中，此时p是一个slice
-		for i, o := range list {
-			val, err := o.Str()
-			if err != nil {
-				return err
-			}
-			v.Index(i).SetString(val)
+// v的类型必须是struct或者key为string的map
+func unmarshalDict(v reflect.Value, dict map[string]*BObject, o *BObject) error {
+	switch v.Kind() {
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("%w: %v", ErrUnsupported, v.Type())
 		}
-	case BINT:
-		for i, o := range list {
-			val, err := o.Int()
-			if err != nil {
-				return err
-			}
-			v.Index(i).SetInt(int64(val))
+		if v.IsNil() {
+			v.Set(reflect.MakeMapWithSize(v.Type(), len(dict)))
 		}
-	case BLIST:
-		for i, o := range list {
-			val, err := o.List()
-			if err != nil {
-				return err
-			}
-
-			if v.Type().Elem().Kind() != reflect.Slice {
-				return ErrTyp
-			}
-
-			// 一个指针，指向slice
-			lp := reflect.New(v.Type().Elem())
-			// 创建一个新的slice，长度和val的长度一样，val为list内层的list
-			ls := reflect.MakeSlice(v.Type().Elem(), len(val), len(val))
-
-			lp.Elem().Set(ls)
-			// 递归地调用unmarshalList，逐步解析
-			err = unmarshalList(lp, val)
+		// map的value不能直接set，先写入一个新的值再放入map
+		et := v.Type().Elem()
+		for key, fo := range dict {
+			ev := reflect.New(et).Elem()
+			err := unmarshalValue(ev, fo)
 			if err != nil {
 				return err
 			}
-
-			// 将v当前index的元素设置为指针lp指向的元素
-			v.Index(i).Set(lp.Elem())
+			v.SetMapIndex(reflect.ValueOf(key).Convert(v.Type().Key()), ev)
 		}
-	case BDICT:
-		for i, o := range list {
-			val, err := o.Dict()
-			if err != nil {
-				return err
-			}
-
-			if v.Type().Elem().Kind() != reflect.Struct {
-				return ErrTyp
+	case reflect.Struct:
+		// 遍历v中所有的filed，设置每个filed的value
+		// 这里遍历的是v的每个filed，根据该filed从Dict中取值设置该filed
+		for _, f := range structFields(v.Type()) {
+			// 从转出来的dict中取出key对应的value
+			fo := dict[f.key]
+			if fo == nil {
+				if f.required {
+					return fmt.Errorf("%w: %q in %v", ErrRequired, f.key, v.Type())
+				}
+				continue
 			}
-
-			// 新建一个指针指向struct
-			dp := reflect.New(v.Type().Elem())
-
-			// 递归解析
-			err = unmarshalDict(dp, val)
-
+			err := unmarshalValue(v.FieldByIndex(f.index), fo)
 			if err != nil {
 				return err
 			}
-
-			// 将v当前index的元素设置为指针dp指向的元素
-			v.Index(i).Set(dp.Elem())
 		}
+	default:
+		return typeErr(o, v.Type())
 	}
 	return nil
 }
 
-// p.Kind() must be Ptr && p.Elem().Type().Kind() must be Struct
-func unmarshalDict(p reflect.Value, dict map[string]*BObject) error {
-	if p.Kind() != reflect.Ptr || p.Elem().Type().Kind() != reflect.Struct {
-		return errors.New("dest must be pointer")
-	}
+// struct中参与编码的field
+type field struct {
+	key       string
+	index     []int // 嵌入的struct中的field需要多级index
+	omitEmpty bool  // 零值时不写入
+	required  bool  // 解码时dict中必须有该key
+}
 
-	v := p.Elem()
-	// 遍历v中所有的filed，设置每个filed的value
-	// 这里遍历的是p指向的struct的每个filed，根据该filed从Dict中取值设置该filed
-	for i, n := 0, v.NumField(); i < n; i++ {
-		// value
-		fv := v.Field(i)
-		if !fv.CanSet() {
+// 列出t中参与编码的field，没有导出的field和tag为"-"的field被忽略
+// 看有没有打上bencode的tag，如果有，就以该tag为key，否则用属性名的小写为key
+// tag中key之后可以跟上以逗号分隔的选项，例如`bencode:"comment,omitempty"`和`bencode:"name,required"`
+// 没有打tag的嵌入struct和encoding/json一样将其field提升到外层，外层的同名field优先
+func structFields(t reflect.Type) []field {
+	var fields, embedded []field
+	seen := make(map[string]bool)
+	for i := 0; i < t.NumField(); i++ {
+		ft := t.Field(i)
+		tag := ft.Tag.Get("bencode")
+		if tag == "-" {
+			continue
+		}
+		key, opts, _ := strings.Cut(tag, ",")
+		if key == "" && ft.Anonymous && ft.Type.Kind() == reflect.Struct {
+			for _, f := range structFields(ft.Type) {
+				f.index = append([]int{i}, f.index...)
+				embedded = append(embedded, f)
+			}
+			continue
+		}
+		if !ft.IsExported() {
 			continue
 		}
-		// filed
-		ft := v.Type().Field(i)
-
-		// 看有没有打上bencode的tag，如果有，就以该tag为key，否则用属性名的小写为key
 		// 因为一般go中暴露出去的属性都是大写开头的，因此先将其转为小写
-		key := ft.Tag.Get("bencode")
 		if key == "" {
 			key = strings.ToLower(ft.Name)
 		}
-
-		// 从转出来的dict中取出key对应的value
-		fo := dict[key]
-		if fo == nil {
-			continue
+		f := field{key: key, index: []int{i}}
+		for _, opt := range strings.Split(opts, ",") {
+			switch opt {
+			case "omitempty":
+				f.omitEmpty = true
+			case "required":
+				f.required = true
+			}
+		}
+		fields = append(fields, f)
+		seen[key] = true
+	}
+	for _, f := range embedded {
+		if !seen[f.key] {
+			fields = append(fields, f)
+			seen[f.key] = true
 		}
+	}
+	return fields
+}
 
-		// 根绝value的类型设置strcut中相应filed的值
-		switch fo.type_ {
-		case BSTR:
-			// 每一个case都会判断是否可以set，若不能set则会直接报错
-			if ft.Type.Kind() != reflect.String {
-				break
-			}
-			val, _ := fo.Str()
-			fv.SetString(val)
-		case BINT:
-			if ft.Type.Kind() != reflect.Int {
-				break
-			}
-			val, _ := fo.Int()
-			fv.SetInt(int64(val))
-		case BLIST:
-			if ft.Type.Kind() != reflect.Slice {
-				break
-			}
+// 编码过程中的状态，先写入缓冲，检查嵌套层数和字符串长度
+type encodeState struct {
+	bytes.Buffer
+	maxDepth  int
+	maxStrLen int
+	depth     int
+	err       error // 第一个错误，出错之后不再写入
+}
 
-			// 下面的和list中一样
-			list, _ := fo.List()
-			lp := reflect.New(ft.Type)
-			ls := reflect.MakeSlice(ft.Type, len(list), len(list))
-			lp.Elem().Set(ls)
-			err := unmarshalList(lp, list)
-			if err != nil {
-				break
-			}
-			// 给当前filed设定指针lp的值
-			fv.Set(lp.Elem())
-		case BDICT:
-			if ft.Type.Kind() != reflect.Struct {
-				break
-			}
+func (es *encodeState) marshal(s interface{}) {
+	if o, ok := s.(*BObject); ok {
+		es.marshalObject(o)
+		return
+	}
+	v := reflect.ValueOf(s)
+	// 这里只需要指针指向位置的值，将其转为字符串，因此使用该操作使其兼容指针
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	es.marshalValue(v)
+}
 
-			// 下面的和list中一样
-			dp := reflect.New(ft.Type)
-			dict, _ := fo.Dict()
-			err := unmarshalDict(dp, dict)
-			if err != nil {
-				break
-			}
-			// 给当前filed设定指针dp的值
-			fv.Set(dp.Elem())
+// 进入一层list或者dict，超过maxDepth时记录错误并返回false
+func (es *encodeState) enter() bool {
+	es.depth++
+	if es.maxDepth > 0 && es.depth > es.maxDepth {
+		es.fail(ErrDepth)
+	}
+	return es.err == nil
+}
+
+func (es *encodeState) leave() {
+	es.depth--
+}
+
+func (es *encodeState) fail(err error) {
+	if es.err == nil {
+		es.err = err
+	}
+}
+
+func (es *encodeState) encodeString(val string) {
+	if es.maxStrLen > 0 && len(val) > es.maxStrLen {
+		es.fail(ErrStrLen)
+	}
+	if es.err != nil {
+		return
+	}
+	es.WriteString(strconv.Itoa(len(val)))
+	es.WriteByte(':')
+	es.WriteString(val)
+}
+
+func (es *encodeState) encodeBytes(val []byte) {
+	if es.maxStrLen > 0 && len(val) > es.maxStrLen {
+		es.fail(ErrStrLen)
+	}
+	if es.err != nil {
+		return
+	}
+	es.WriteString(strconv.Itoa(len(val)))
+	es.WriteByte(':')
+	es.Write(val)
+}
+
+// num是整数的十进制表示，int64、uint64和big.Int都通过这里写入
+func (es *encodeState) encodeNum(num string) {
+	if es.err != nil {
+		return
+	}
+	es.WriteByte('i')
+	es.WriteString(num)
+	es.WriteByte('e')
+}
+
+// 和BObject.Bencode相同，但是检查嵌套层数和字符串长度
+func (es *encodeState) marshalObject(o *BObject) {
+	switch o.type_ {
+	case BSTR:
+		str, _ := o.Bytes()
+		es.encodeBytes(str)
+	case BINT:
+		es.encodeNum(o.intString())
+	case BLIST:
+		defer es.leave()
+		if !es.enter() {
+			return
+		}
+		es.WriteByte('l')
+		list, _ := o.List()
+		for _, elem := range list {
+			es.marshalObject(elem)
+		}
+		es.WriteByte('e')
+	case BDICT:
+		defer es.leave()
+		if !es.enter() {
+			return
 		}
+		es.WriteByte('d')
+		dict, _ := o.Dict()
+		for _, k := range sortedKeys(dict) {
+			es.encodeString(k)
+			es.marshalObject(dict[k])
+		}
+		es.WriteByte('e')
 	}
-	return nil
 }
 
-func marshalValue(w io.Writer, v reflect.Value) int {
-	len := 0
+// 调用m的MarshalBencode，并检查其返回的是否是一个完整的bencode值，避免写出损坏的数据
+func (es *encodeState) marshalCustom(m Marshaler) {
+	if es.err != nil {
+		return
+	}
+	b, err := m.MarshalBencode()
+	if err != nil {
+		es.fail(err)
+		return
+	}
+	r := bytes.NewReader(b)
+	d := NewDecoder(r)
+	_, err = d.DecodeObject()
+	if err == nil && (d.r.Buffered() > 0 || r.Len() > 0) {
+		err = ErrIvd
+	}
+	if err != nil {
+		es.fail(fmt.Errorf("%T.MarshalBencode: %w", m, err))
+		return
+	}
+	es.Write(b)
+}
+
+func (es *encodeState) marshalValue(v reflect.Value) {
+	if !v.IsValid() {
+		es.fail(ErrNil)
+		return
+	}
+	if m, ok := marshaler(v); ok {
+		es.marshalCustom(m)
+		return
+	}
+	if v.Type() == bigIntType {
+		val := v.Interface().(big.Int)
+		es.encodeNum(val.String())
+		return
+	}
 	switch v.Kind() {
 	case reflect.String:
-		len += EncodeString(w, v.String())
-	case reflect.Int:
-		len += EncodeInt(w, int(v.Int()))
+		es.encodeString(v.String())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		es.encodeNum(strconv.FormatInt(v.Int(), 10))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		es.encodeNum(strconv.FormatUint(v.Uint(), 10))
+	case reflect.Bool:
+		if v.Bool() {
+			es.encodeNum("1")
+		} else {
+			es.encodeNum("0")
+		}
 	case reflect.Slice:
-		len += marshalList(w, v)
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			es.encodeString(string(v.Bytes()))
+			break
+		}
+		es.marshalList(v)
+	case reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			buf := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(buf), v)
+			es.encodeString(string(buf))
+			break
+		}
+		es.marshalList(v)
+	case reflect.Map:
+		es.marshalMap(v)
 	case reflect.Struct:
-		len += marshalDict(w, v)
+		es.marshalDict(v)
+	case reflect.Ptr, reflect.Interface:
+		// nil没有对应的bencode值，dict中的nil会被跳过，其他位置的nil是错误
+		if v.IsNil() {
+			es.fail(ErrNil)
+			break
+		}
+		es.marshalValue(v.Elem())
+	default:
+		es.fail(fmt.Errorf("%w: %v", ErrUnsupported, v.Type()))
 	}
-	return len
 }
 
-func marshalList(w io.Writer, vl reflect.Value) int {
-	// 为开头的l和结尾的e，共两个字符
-	len := 2
-	w.Write([]byte{'l'})
+func (es *encodeState) marshalList(vl reflect.Value) {
+	defer es.leave()
+	if !es.enter() {
+		return
+	}
+	es.WriteByte('l')
 
 	// 遍历list中的元素
 	for i := 0; i < vl.Len(); i++ {
 		ev := vl.Index(i)
-		len += marshalValue(w, ev)
+		es.marshalValue(ev)
 	}
 
-	w.Write([]byte{'e'})
-	return len
+	es.WriteByte('e')
 }
 
-func marshalDict(w io.Writer, vd reflect.Value) int {
-	// 为开头的d和结尾的e，共两个字符
-	len := 2
-	w.Write([]byte{'d'})
+// 值为nil的指针或接口
+func isNil(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	}
+	return false
+}
 
-	// 遍历map中的元素
-	for i := 0; i < vd.NumField(); i++ {
-		fv := vd.Field(i)
-		ft := vd.Type().Field(i)
-		key := ft.Tag.Get("bencode")
-		if key == "" {
-			key = strings.ToLower(ft.Name)
+// omitempty认为是空的值，和encoding/json相同，struct不会被认为是空的
+func isEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	}
+	return isNil(v)
+}
+
+func (es *encodeState) marshalMap(vm reflect.Value) {
+	if vm.Type().Key().Kind() != reflect.String {
+		es.fail(fmt.Errorf("%w: %v", ErrUnsupported, vm.Type()))
+		return
+	}
+	defer es.leave()
+	if !es.enter() {
+		return
+	}
+	es.WriteByte('d')
+
+	// key按原始byte排序之后再写入
+	keys := make([]string, 0, vm.Len())
+	values := make(map[string]reflect.Value, vm.Len())
+	iter := vm.MapRange()
+	for iter.Next() {
+		if isNil(iter.Value()) {
+			continue
 		}
-		len += EncodeString(w, key)
-		len += marshalValue(w, fv)
+		key := iter.Key().String()
+		keys = append(keys, key)
+		values[key] = iter.Value()
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		es.encodeString(key)
+		es.marshalValue(values[key])
 	}
 
-	w.Write([]byte{'e'})
-	return len
+	es.WriteByte('e')
 }
 
-// 将go中的slice或struct转为torrent格式的字符串，可以灵活处理不同类型的slice和struct
-func Marshal(w io.Writer, s interface{}) int {
-	v := reflect.ValueOf(s)
-	// 这里只需要指针指向位置的值，将其转为字符串，因此使用该操作使其兼容指针
-	if v.Kind() == reflect.Ptr {
-		v = v.Elem()
+func (es *encodeState) marshalDict(vd reflect.Value) {
+	defer es.leave()
+	if !es.enter() {
+		return
+	}
+	es.WriteByte('d')
+
+	// 遍历struct中的field，key按原始byte排序之后再写入，而不是field的顺序
+	fields := structFields(vd.Type())
+	sort.Slice(fields, func(i, j int) bool {
+		return fields[i].key < fields[j].key
+	})
+	for _, f := range fields {
+		fv := vd.FieldByIndex(f.index)
+		if isNil(fv) || f.omitEmpty && isEmpty(fv) {
+			continue
+		}
+		es.encodeString(f.key)
+		es.marshalValue(fv)
+	}
+
+	es.WriteByte('e')
+}
+
+// 将go中的值转为torrent格式的字符串，可以灵活处理struct、slice、map以及Unmarshal写入interface{}的值
+// 返回写入的byte数，编码出错时不会写入任何数据
+func Marshal(w io.Writer, s interface{}) (int, error) {
+	es := &encodeState{}
+	es.marshal(s)
+	if es.err != nil {
+		return 0, es.err
 	}
-	return marshalValue(w, v)
+	return w.Write(es.Bytes())
 }
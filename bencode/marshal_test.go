@@ -2,7 +2,12 @@ package bencode
 
 import (
 	"bytes"
+	"errors"
+	"io"
+	"math"
+	"math/big"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -31,13 +36,15 @@ type Team struct {
 func TestMarshalBasic(t *testing.T) {
 	buf := new(bytes.Buffer)
 	str := "abc"
-	len := Marshal(buf, str)
+	len, err := Marshal(buf, str)
+	assert.Equal(t, nil, err)
 	assert.Equal(t, 5, len)
 	assert.Equal(t, "3:abc", buf.String())
 
 	buf.Reset()
 	val := 199
-	len = Marshal(buf, val)
+	len, err = Marshal(buf, val)
+	assert.Equal(t, nil, err)
 	assert.Equal(t, 5, len)
 	assert.Equal(t, "i199e", buf.String())
 }
@@ -50,13 +57,14 @@ func TestUnmarshalList(t *testing.T) {
 
 	// 测试list的Marshal
 	buf := new(bytes.Buffer)
-	length := Marshal(buf, l)
+	length, err := Marshal(buf, l)
+	assert.Equal(t, nil, err)
 	assert.Equal(t, len(str), length)
 	assert.Equal(t, str, buf.String())
 }
 
 func TestUnmarshalUser(t *testing.T) {
-	str := "d4:name7:patrick3:agei23ee"
+	str := "d3:agei23e4:name7:patricke"
 	u := &User{}
 	Unmarshal(bytes.NewBufferString(str), u)
 	assert.Equal(t, "patrick", u.Name)
@@ -64,13 +72,14 @@ func TestUnmarshalUser(t *testing.T) {
 
 	// 测试dict的Marshal
 	buf := new(bytes.Buffer)
-	length := Marshal(buf, u)
+	length, err := Marshal(buf, u)
+	assert.Equal(t, nil, err)
 	assert.Equal(t, len(str), length)
 	assert.Equal(t, str, buf.String())
 }
 
 func TestUnmarshalRole(t *testing.T) {
-	str := "d2:idi1e4:userd4:name7:patrick3:agei23eee"
+	str := "d2:idi1e4:userd3:agei23e4:name7:patrickee"
 	r := &Role{}
 	Unmarshal(bytes.NewBufferString(str), r)
 	assert.Equal(t, 1, r.Id)
@@ -78,13 +87,14 @@ func TestUnmarshalRole(t *testing.T) {
 	assert.Equal(t, 23, r.Age)
 
 	buf := new(bytes.Buffer)
-	length := Marshal(buf, r)
+	length, err := Marshal(buf, r)
+	assert.Equal(t, nil, err)
 	assert.Equal(t, len(str), length)
 	assert.Equal(t, str, buf.String())
 }
 
 func TestUnmarshalScore(t *testing.T) {
-	str := "d4:userd4:name7:patrick3:agei23ee5:valueli80ei85ei90eee"
+	str := "d4:userd3:agei23e4:name7:patricke5:valueli80ei85ei90eee"
 	s := &Score{}
 	Unmarshal(bytes.NewBufferString(str), s)
 	assert.Equal(t, "patrick", s.Name)
@@ -92,20 +102,419 @@ func TestUnmarshalScore(t *testing.T) {
 	assert.Equal(t, []int{80, 85, 90}, s.Value)
 
 	buf := new(bytes.Buffer)
-	length := Marshal(buf, s)
+	length, err := Marshal(buf, s)
+	assert.Equal(t, nil, err)
 	assert.Equal(t, len(str), length)
 	assert.Equal(t, str, buf.String())
 }
 
 func TestUnmarshalTeam(t *testing.T) {
-	str := "d4:name3:ace4:sizei2e6:memberld4:name7:patrick3:agei23eed4:name5:nancy3:agei31eeee"
+	str := "d6:memberld3:agei23e4:name7:patricked3:agei31e4:name5:nancyee4:name3:ace4:sizei2ee"
 	team := &Team{}
 	Unmarshal(bytes.NewBufferString(str), team)
 	assert.Equal(t, "ace", team.Name)
 	assert.Equal(t, 2, team.Size)
 
 	buf := new(bytes.Buffer)
-	length := Marshal(buf, team)
+	length, err := Marshal(buf, team)
+	assert.Equal(t, nil, err)
 	assert.Equal(t, len(str), length)
 	assert.Equal(t, str, buf.String())
 }
+
+func TestMarshalSortedKeys(t *testing.T) {
+	// field的顺序和key的顺序不同时，按key排序写入
+	type info struct {
+		Pieces string `bencode:"pieces"`
+		Name   string `bencode:"name"`
+		Length int    `bencode:"length"`
+		PLen   int    `bencode:"piece length"`
+	}
+	buf := new(bytes.Buffer)
+	Marshal(buf, info{"abc", "a.txt", 3, 16})
+	assert.Equal(t, "d6:lengthi3e4:name5:a.txt12:piece lengthi16e6:pieces3:abce", buf.String())
+}
+
+// 编码为20个字节的字符串
+type hash [20]byte
+
+func (h hash) MarshalBencode() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if _, err := EncodeString(buf, string(h[:])); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (h *hash) UnmarshalBencode(b []byte) error {
+	str, err := DecodeString(bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	if len(str) != len(h) {
+		return errors.New("hash must be 20 bytes")
+	}
+	copy(h[:], str)
+	return nil
+}
+
+// 编码为unix时间戳
+type date struct {
+	time.Time
+}
+
+func (d date) MarshalBencode() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if _, err := EncodeInt(buf, int(d.Unix())); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (d *date) UnmarshalBencode(b []byte) error {
+	val, err := DecodeInt(bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	d.Time = time.Unix(int64(val), 0)
+	return nil
+}
+
+type meta struct {
+	Name    string `bencode:"name"`
+	Hash    hash   `bencode:"hash"`
+	Created date   `bencode:"creation date"`
+	Hashes  []hash `bencode:"hashes"`
+}
+
+func TestMarshalerRoundTrip(t *testing.T) {
+	h1 := hash{1, 2, 3}
+	h2 := hash{4, 5, 6}
+	m := meta{Name: "a", Hash: h1, Created: date{time.Unix(1700000000, 0)}, Hashes: []hash{h1, h2}}
+
+	buf := new(bytes.Buffer)
+	length, err := Marshal(buf, m)
+	assert.Equal(t, nil, err)
+	str := "d13:creation datei1700000000e4:hash20:" + string(h1[:]) +
+		"6:hashesl20:" + string(h1[:]) + "20:" + string(h2[:]) + "e4:name1:ae"
+	assert.Equal(t, len(str), length)
+	assert.Equal(t, str, buf.String())
+
+	res := &meta{}
+	err = Unmarshal(bytes.NewBufferString(str), res)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "a", res.Name)
+	assert.Equal(t, h1, res.Hash)
+	assert.Equal(t, int64(1700000000), res.Created.Unix())
+	assert.Equal(t, []hash{h1, h2}, res.Hashes)
+
+	// 顶层的值也可以实现Unmarshaler
+	var h hash
+	err = Unmarshal(bytes.NewBufferString("20:"+string(h2[:])), &h)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, h2, h)
+}
+
+func TestUnmarshalerError(t *testing.T) {
+	res := &meta{}
+	err := Unmarshal(bytes.NewBufferString("d4:hash3:abce"), res)
+	assert.NotEqual(t, nil, err)
+}
+
+type badMarshaler string
+
+func (b badMarshaler) MarshalBencode() ([]byte, error) {
+	if b == "" {
+		return nil, errors.New("empty")
+	}
+	return []byte(b), nil
+}
+
+func TestMarshalerError(t *testing.T) {
+	type wrap struct {
+		B badMarshaler `bencode:"b"`
+	}
+	buf := new(bytes.Buffer)
+	n, err := Marshal(buf, wrap{""})
+	assert.Equal(t, 0, n)
+	assert.Equal(t, "empty", err.Error())
+	assert.Equal(t, 0, buf.Len())
+
+	// 返回的不是一个完整的bencode值
+	err = NewEncoder(buf).Encode(wrap{"3:ab"})
+	assert.NotEqual(t, nil, err)
+	err = NewEncoder(buf).Encode(wrap{"i1ei2e"})
+	assert.True(t, errors.Is(err, ErrIvd))
+	assert.Equal(t, 0, buf.Len())
+
+	assert.Equal(t, nil, NewEncoder(buf).Encode(wrap{"i1e"}))
+	assert.Equal(t, "d1:bi1ee", buf.String())
+}
+
+type Base struct {
+	Id   int64 `bencode:"id"`
+	Name string
+}
+
+type kinds struct {
+	Base
+	Name    string            `bencode:"name"`
+	Port    uint16            `bencode:"port"`
+	Private bool              `bencode:"private"`
+	Small   int8              `bencode:"small"`
+	Big     uint64            `bencode:"big"`
+	Raw     []byte            `bencode:"raw"`
+	Hash    [4]byte           `bencode:"hash"`
+	Pair    [2]int            `bencode:"pair"`
+	Ptr     *User             `bencode:"ptr"`
+	Nil     *User             `bencode:"nil"`
+	Attrs   map[string]uint32 `bencode:"attrs"`
+	Any     interface{}       `bencode:"any"`
+	hidden  int
+}
+
+func TestMarshalKinds(t *testing.T) {
+	k := kinds{
+		Base:    Base{Id: 7, Name: "shadowed"},
+		Name:    "a",
+		Port:    6881,
+		Private: true,
+		Small:   -3,
+		Big:     1 << 40,
+		Raw:     []byte{0xff, 0x00},
+		Hash:    [4]byte{'a', 'b', 'c', 'd'},
+		Pair:    [2]int{1, 2},
+		Ptr:     &User{Name: "nancy", Age: 31},
+		Attrs:   map[string]uint32{"y": 2, "x": 1},
+		Any:     []interface{}{"s", int64(1)},
+		hidden:  5,
+	}
+	buf := new(bytes.Buffer)
+	length, err := Marshal(buf, &k)
+	assert.Equal(t, nil, err)
+	// 嵌入的struct中的field提升到外层，同名的field外层优先，nil指针和没有导出的field被跳过
+	str := "d3:anyl1:si1ee5:attrsd1:xi1e1:yi2ee3:bigi1099511627776e4:hash4:abcd2:idi7e" +
+		"4:name1:a4:pairli1ei2ee4:porti6881e7:privatei1e3:ptrd3:agei31e4:name5:nancye" +
+		"3:raw2:\xff\x005:smalli-3ee"
+	assert.Equal(t, len(str), length)
+	assert.Equal(t, str, buf.String())
+
+	res := &kinds{}
+	err = Unmarshal(bytes.NewBufferString(str), res)
+	assert.Equal(t, nil, err)
+	k.Base.Name = ""
+	k.hidden = 0
+	assert.Equal(t, k, *res)
+}
+
+func TestUnmarshalOverflow(t *testing.T) {
+	var small struct {
+		Small int8 `bencode:"small"`
+	}
+	err := Unmarshal(bytes.NewBufferString("d5:smalli200ee"), &small)
+	assert.True(t, errors.Is(err, ErrOverflow))
+
+	var port struct {
+		Port uint16 `bencode:"port"`
+	}
+	err = Unmarshal(bytes.NewBufferString("d4:porti-1ee"), &port)
+	assert.True(t, errors.Is(err, ErrOverflow))
+	err = Unmarshal(bytes.NewBufferString("d4:porti65536ee"), &port)
+	assert.True(t, errors.Is(err, ErrOverflow))
+	err = Unmarshal(bytes.NewBufferString("d4:porti65535ee"), &port)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, uint16(65535), port.Port)
+}
+
+func TestUnmarshalTypeMismatch(t *testing.T) {
+	u := &User{}
+	err := Unmarshal(bytes.NewBufferString("d3:age3:abce"), u)
+	assert.True(t, errors.Is(err, ErrTyp))
+
+	// 嵌套的list中的错误也会返回
+	team := &Team{}
+	err = Unmarshal(bytes.NewBufferString("d6:memberld3:agei1eeli1eeee"), team)
+	assert.True(t, errors.Is(err, ErrTyp))
+
+	var hash struct {
+		Hash [4]byte `bencode:"hash"`
+	}
+	err = Unmarshal(bytes.NewBufferString("d4:hash3:abce"), &hash)
+	assert.True(t, errors.Is(err, ErrTyp))
+
+	var flag struct {
+		Flag bool `bencode:"flag"`
+	}
+	err = Unmarshal(bytes.NewBufferString("d4:flagi2ee"), &flag)
+	assert.True(t, errors.Is(err, ErrTyp))
+}
+
+func TestMarshalUnsupported(t *testing.T) {
+	buf := new(bytes.Buffer)
+	err := NewEncoder(buf).Encode(struct {
+		Ratio float64 `bencode:"ratio"`
+	}{1.5})
+	assert.True(t, errors.Is(err, ErrUnsupported))
+
+	err = NewEncoder(buf).Encode(map[int]string{1: "a"})
+	assert.True(t, errors.Is(err, ErrUnsupported))
+
+	err = NewEncoder(buf).Encode([]*User{nil})
+	assert.Equal(t, ErrNil, err)
+	assert.Equal(t, 0, buf.Len())
+
+	var ch struct {
+		C chan int `bencode:"c"`
+	}
+	err = Unmarshal(bytes.NewBufferString("d1:ci1ee"), &ch)
+	assert.True(t, errors.Is(err, ErrUnsupported))
+
+	var m map[int]string
+	err = Unmarshal(bytes.NewBufferString("d1:ai1ee"), &m)
+	assert.True(t, errors.Is(err, ErrUnsupported))
+}
+
+type options struct {
+	Name    string   `bencode:"name,required"`
+	Comment string   `bencode:"comment,omitempty"`
+	Private int      `bencode:"private,omitempty"`
+	Nodes   []string `bencode:"nodes,omitempty"`
+	Cache   string   `bencode:"-"`
+	Dash    int      `bencode:"-,"`
+}
+
+func TestMarshalTagOptions(t *testing.T) {
+	buf := new(bytes.Buffer)
+	Marshal(buf, options{Name: "a", Cache: "x"})
+	assert.Equal(t, "d1:-i0e4:name1:ae", buf.String())
+
+	buf.Reset()
+	Marshal(buf, options{Name: "a", Comment: "c", Private: 1, Nodes: []string{"n"}, Dash: 2})
+	assert.Equal(t, "d1:-i2e7:comment1:c4:name1:a5:nodesl1:ne7:privatei1ee", buf.String())
+}
+
+func TestUnmarshalTagOptions(t *testing.T) {
+	o := &options{}
+	err := Unmarshal(bytes.NewBufferString("d5:cache1:x7:comment1:c4:name1:ae"), o)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, options{Name: "a", Comment: "c"}, *o)
+
+	// 缺少required的key
+	o = &options{}
+	err = Unmarshal(bytes.NewBufferString("d7:comment1:ce"), o)
+	assert.True(t, errors.Is(err, ErrRequired))
+}
+
+type failWriter struct{}
+
+func (failWriter) Write(p []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+func TestMarshalWriteError(t *testing.T) {
+	n, err := Marshal(failWriter{}, User{Name: "patrick"})
+	assert.Equal(t, 0, n)
+	assert.Equal(t, io.ErrClosedPipe, err)
+}
+
+func TestMarshalBigInt(t *testing.T) {
+	type sizes struct {
+		Big   *big.Int `bencode:"big"`
+		Total uint64   `bencode:"total"`
+		Small int64    `bencode:"small"`
+	}
+	b, _ := new(big.Int).SetString("123456789012345678901234567890", 10)
+	s := sizes{Big: b, Total: math.MaxUint64, Small: math.MinInt64}
+	buf := new(bytes.Buffer)
+	_, err := Marshal(buf, s)
+	assert.Equal(t, nil, err)
+	str := "d3:bigi123456789012345678901234567890e5:smalli-9223372036854775808e5:totali18446744073709551615ee"
+	assert.Equal(t, str, buf.String())
+
+	res := &sizes{}
+	err = Unmarshal(bytes.NewBufferString(str), res)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, b.Cmp(res.Big))
+	assert.Equal(t, uint64(math.MaxUint64), res.Total)
+	assert.Equal(t, int64(math.MinInt64), res.Small)
+
+	// 超出int64范围的整数不能写入int64
+	err = Unmarshal(bytes.NewBufferString("d5:smalli9223372036854775808ee"), res)
+	assert.True(t, errors.Is(err, ErrOverflow))
+}
+
+func TestUnmarshalGeneric(t *testing.T) {
+	str := "d1:ad2:id20:abcdefghij01234567896:target20:mnopqrstuvwxyz123456e1:q9:find_node1:t2:aa1:y1:qe"
+	var v interface{}
+	err := Unmarshal(bytes.NewBufferString(str), &v)
+	assert.Equal(t, nil, err)
+	expect := map[string]interface{}{
+		"a": map[string]interface{}{"id": "abcdefghij0123456789", "target": "mnopqrstuvwxyz123456"},
+		"q": "find_node",
+		"t": "aa",
+		"y": "q",
+	}
+	assert.Equal(t, expect, v)
+
+	// 解码出来的值可以直接编码回去
+	buf := new(bytes.Buffer)
+	_, err = Marshal(buf, v)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, str, buf.String())
+
+	var m map[string]any
+	err = Unmarshal(bytes.NewBufferString("d1:lli1ei-2e1:xe1:ni3ee"), &m)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, map[string]any{"l": []any{int64(1), int64(-2), "x"}, "n": int64(3)}, m)
+
+	buf.Reset()
+	_, err = Marshal(buf, &m)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "d1:lli1ei-2e1:xe1:ni3ee", buf.String())
+}
+
+func TestUnmarshalScalar(t *testing.T) {
+	var s string
+	err := Unmarshal(bytes.NewBufferString("3:abc"), &s)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "abc", s)
+
+	var n int64
+	err = Unmarshal(bytes.NewBufferString("i-42e"), &n)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, int64(-42), n)
+
+	var v any
+	err = Unmarshal(bytes.NewBufferString("i7e"), &v)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, int64(7), v)
+
+	err = Unmarshal(bytes.NewBufferString("3:abc"), &n)
+	assert.True(t, errors.Is(err, ErrTyp))
+	err = Unmarshal(bytes.NewBufferString("3:abc"), n)
+	assert.NotEqual(t, nil, err)
+
+	var o BObject
+	err = Unmarshal(bytes.NewBufferString("l3:abce"), &o)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, BLIST, o.Type())
+}
+
+func TestMarshalGeneric(t *testing.T) {
+	msg := map[string]any{
+		"t": "aa",
+		"y": "r",
+		"r": map[string]any{"id": []byte("0123456789abcdefghij"), "port": 6881},
+		"e": nil,
+		"v": []any{int64(1), "x", uint8(2)},
+	}
+	buf := new(bytes.Buffer)
+	_, err := Marshal(buf, msg)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "d1:rd2:id20:0123456789abcdefghij4:porti6881ee1:t2:aa1:vli1e1:xi2ee1:y1:re", buf.String())
+
+	_, err = Marshal(buf, []any{nil})
+	assert.Equal(t, ErrNil, err)
+	_, err = Marshal(buf, map[string]any{"f": 1.5})
+	assert.True(t, errors.Is(err, ErrUnsupported))
+}
@@ -2,53 +2,134 @@ package bencode
 
 import (
 	"bufio"
+	"bytes"
+	"fmt"
 	"io"
+	"strconv"
 )
 
 func Parse(r io.Reader) (*BObject, error) {
-	br, ok := r.(*bufio.Reader)
-	if !ok {
-		br = bufio.NewReader(r)
+	return NewDecoder(r).DecodeObject()
+}
+
+// 和Parse相同，但是dict的key没有按原始byte排序或者有重复时返回错误
+// 用来检查输入是否是规范的bencode，比如计算info hash之前
+func ParseStrict(r io.Reader) (*BObject, error) {
+	d := NewDecoder(r)
+	d.SetStrict(true)
+	return d.DecodeObject()
+}
+
+// 读取下一个byte但不消耗，输入在一个值的中间结束时返回io.ErrUnexpectedEOF
+func peekByte(br *bufio.Reader) (byte, error) {
+	b, err := br.Peek(1)
+	if err == io.EOF {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+// 解析出错的位置，Offset是出错时已经读取的byte数，Path是出错的值在整个输入中的路径，例如info.files[3].length
+// Err是具体的错误，可以通过errors.Is判断，比如ErrNum和io.ErrUnexpectedEOF
+type SyntaxError struct {
+	Offset int64
+	Path   string
+	Err    error
+}
+
+func (e *SyntaxError) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("%v at offset %d", e.Err, e.Offset)
+	}
+	return fmt.Sprintf("%v at offset %d in %s", e.Err, e.Offset, e.Path)
+}
+
+func (e *SyntaxError) Unwrap() error {
+	return e.Err
+}
+
+// 错误从内层的值返回到外层时，在路径前面加上外层的key或者index
+func (e *SyntaxError) prepend(seg string) {
+	if e.Path == "" || e.Path[0] == '[' {
+		e.Path = seg + e.Path
+	} else {
+		e.Path = seg + "." + e.Path
+	}
+}
+
+func errAt(off int64, err error) error {
+	return &SyntaxError{Offset: off, Err: err}
+}
+
+// 内层返回的一定是*SyntaxError
+func withPath(err error, seg string) error {
+	if se, ok := err.(*SyntaxError); ok {
+		se.prepend(seg)
+	}
+	return err
+}
+
+func (d *Decoder) parse(depth int) (*BObject, error) {
+	br := d.r
+	if d.maxDepth > 0 && depth > d.maxDepth {
+		return nil, errAt(d.off, ErrDepth)
 	}
 
 	// recrusive descent parsing
 	b, err := br.Peek(1)
 	if err != nil {
-		return nil, err
+		// 最外层没有任何输入时返回io.EOF，表示流结束
+		if err == io.EOF {
+			if depth == 0 {
+				return nil, err
+			}
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, errAt(d.off, err)
 	}
 
 	var ret BObject
 	switch {
 	case b[0] >= '0' && b[0] <= '9':
 		// parsing string
-		val, err := DecodeString(br)
+		val, n, err := decodeBytes(br, d.maxStrLen)
+		d.off += int64(n)
 		if err != nil {
-			return nil, err
+			return nil, errAt(d.off, err)
 		}
 		ret.type_ = BSTR
 		ret.val_ = val
 	case b[0] == 'i':
 		// parsing int
-		val, err := DecodeInt(br)
+		val, n, err := decodeInt(br)
+		d.off += int64(n)
 		if err != nil {
-			return nil, err
+			return nil, errAt(d.off, err)
 		}
-		ret.type_ = BINT
-		ret.val_ = val
+		ret = *val
 	case b[0] == 'l':
 		// parsing list
 		br.ReadByte()
+		d.off++
 		var list []*BObject
 		for {
 			// 读到了最后
-			if p, _ := br.Peek(1); p[0] == 'e' {
+			p, err := peekByte(br)
+			if err != nil {
+				return nil, errAt(d.off, err)
+			}
+			if p == 'e' {
 				br.ReadByte()
+				d.off++
 				break
 			}
 
-			elem, err := Parse(br)
+			elem, err := d.parse(depth + 1)
 			if err != nil {
-				return nil, err
+				return nil, withPath(err, "["+strconv.Itoa(len(list))+"]")
 			}
 			list = append(list, elem)
 		}
@@ -57,30 +138,228 @@ func Parse(r io.Reader) (*BObject, error) {
 	case b[0] == 'd':
 		// parsing map
 		br.ReadByte()
+		d.off++
 		dict := make(map[string]*BObject)
+		var last string
 		for {
 			// 读到了最后
-			if p, _ := br.Peek(1); p[0] == 'e' {
+			p, err := peekByte(br)
+			if err != nil {
+				return nil, errAt(d.off, err)
+			}
+			if p == 'e' {
 				br.ReadByte()
+				d.off++
 				break
 			}
 			// 读取key
-
-			key, err := DecodeString(br)
+			keyOff := d.off
+			key, n, err := decodeString(br, d.maxStrLen)
+			d.off += int64(n)
 			if err != nil {
-				return nil, err
+				return nil, errAt(d.off, err)
 			}
+			if d.strict && len(dict) > 0 {
+				if key == last {
+					return nil, withPath(errAt(keyOff, ErrKeyDup), key)
+				}
+				if key < last {
+					return nil, withPath(errAt(keyOff, ErrKeyOrder), key)
+				}
+			}
+			last = key
 
-			val, err := Parse(br)
+			val, err := d.parse(depth + 1)
 			if err != nil {
-				return nil, err
+				return nil, withPath(err, key)
 			}
 			dict[key] = val
 		}
 		ret.type_ = BDICT
 		ret.val_ = dict
 	default:
-		return nil, ErrIvd
+		return nil, errAt(d.off, ErrIvd)
 	}
 	return &ret, nil
 }
+
+// ParseBytes默认允许的list和dict嵌套层数，输入通常来自不可信的文件或者网络，递归过深会耗尽栈
+const DefaultMaxDepth = 512
+
+// ParseBytesWith的选项，含义和Decoder中对应的设置相同
+type ParseOptions struct {
+	Strict   bool // dict的key必须按原始byte排序并且不能重复
+	MaxDepth int  // list和dict嵌套的最大层数，为0时使用DefaultMaxDepth
+}
+
+// 从一段完整的输入中解析一个值，解析出来的字符串直接引用data，不会拷贝
+// 因此data在返回的BObject使用期间不能被修改，输入在值之后还有多余的数据时返回错误
+// 嵌套超过DefaultMaxDepth层时返回ErrDepth
+func ParseBytes(data []byte) (*BObject, error) {
+	return ParseBytesWith(data, ParseOptions{})
+}
+
+// 和ParseBytes相同，可以指定严格模式和嵌套的层数
+func ParseBytesWith(data []byte, opts ParseOptions) (*BObject, error) {
+	p := &byteParser{data: data, strict: opts.Strict, maxDepth: opts.MaxDepth}
+	if p.maxDepth <= 0 {
+		p.maxDepth = DefaultMaxDepth
+	}
+	o, err := p.parse(0)
+	if err != nil {
+		return nil, err
+	}
+	if p.off != len(data) {
+		return nil, errAt(int64(p.off), ErrIvd)
+	}
+	return o, nil
+}
+
+// ParseBytes使用的解析器，直接在data上移动下标，不经过bufio
+type byteParser struct {
+	data     []byte
+	off      int
+	strict   bool
+	maxDepth int
+}
+
+func (p *byteParser) errAt(err error) error {
+	return errAt(int64(p.off), err)
+}
+
+// 读取连续的数字，和readDigits相同
+func (p *byteParser) digits() []byte {
+	start := p.off
+	for p.off < len(p.data) && checkNum(p.data[p.off]) {
+		p.off++
+	}
+	return p.data[start:p.off]
+}
+
+func (p *byteParser) bytes() ([]byte, error) {
+	digits := p.digits()
+	if len(digits) == 0 {
+		return nil, p.errAt(ErrNum)
+	}
+	num, err := strconv.Atoi(string(digits))
+	if err != nil {
+		return nil, p.errAt(ErrStrLen)
+	}
+	if p.off == len(p.data) {
+		return nil, p.errAt(io.ErrUnexpectedEOF)
+	}
+	if p.data[p.off] != ':' {
+		return nil, p.errAt(ErrCol)
+	}
+	p.off++
+	if num > len(p.data)-p.off {
+		p.off = len(p.data)
+		return nil, p.errAt(io.ErrUnexpectedEOF)
+	}
+	// 限制cap，避免调用者append时覆盖后面的输入
+	val := p.data[p.off : p.off+num : p.off+num]
+	p.off += num
+	return val, nil
+}
+
+func (p *byteParser) int() (*BObject, error) {
+	p.off++
+	neg := false
+	if p.off < len(p.data) && p.data[p.off] == '-' {
+		p.off++
+		neg = true
+	}
+	digits := p.digits()
+	if err := checkInt(neg, digits); err != nil {
+		return nil, p.errAt(err)
+	}
+	if p.off == len(p.data) {
+		return nil, p.errAt(io.ErrUnexpectedEOF)
+	}
+	if p.data[p.off] != 'e' {
+		return nil, p.errAt(ErrEpE)
+	}
+	p.off++
+	return newInt(neg, digits), nil
+}
+
+// 读取下一个byte但不消耗
+func (p *byteParser) peek() (byte, error) {
+	if p.off == len(p.data) {
+		return 0, p.errAt(io.ErrUnexpectedEOF)
+	}
+	return p.data[p.off], nil
+}
+
+func (p *byteParser) parse(depth int) (*BObject, error) {
+	if depth > p.maxDepth {
+		return nil, p.errAt(ErrDepth)
+	}
+	b, err := p.peek()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case checkNum(b):
+		val, err := p.bytes()
+		if err != nil {
+			return nil, err
+		}
+		return &BObject{type_: BSTR, val_: val}, nil
+	case b == 'i':
+		return p.int()
+	case b == 'l':
+		p.off++
+		var list []*BObject
+		for {
+			b, err := p.peek()
+			if err != nil {
+				return nil, err
+			}
+			if b == 'e' {
+				p.off++
+				return &BObject{type_: BLIST, val_: list}, nil
+			}
+			elem, err := p.parse(depth + 1)
+			if err != nil {
+				return nil, withPath(err, "["+strconv.Itoa(len(list))+"]")
+			}
+			list = append(list, elem)
+		}
+	case b == 'd':
+		p.off++
+		dict := make(map[string]*BObject)
+		var last []byte
+		for {
+			b, err := p.peek()
+			if err != nil {
+				return nil, err
+			}
+			if b == 'e' {
+				p.off++
+				return &BObject{type_: BDICT, val_: dict}, nil
+			}
+			keyOff := p.off
+			key, err := p.bytes()
+			if err != nil {
+				return nil, err
+			}
+			if p.strict && len(dict) > 0 {
+				switch bytes.Compare(key, last) {
+				case 0:
+					return nil, withPath(errAt(int64(keyOff), ErrKeyDup), string(key))
+				case -1:
+					return nil, withPath(errAt(int64(keyOff), ErrKeyOrder), string(key))
+				}
+			}
+			last = key
+			val, err := p.parse(depth + 1)
+			if err != nil {
+				return nil, withPath(err, string(key))
+			}
+			dict[string(key)] = val
+		}
+	}
+	return nil, p.errAt(ErrIvd)
+}
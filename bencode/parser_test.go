@@ -2,6 +2,9 @@ package bencode
 
 import (
 	"bytes"
+	"errors"
+	"io"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -29,7 +32,9 @@ func TestParseString(t *testing.T) {
 	objAssertStr(t, "abc", o)
 
 	out := bytes.NewBufferString("")
-	assert.Equal(t, len(in), o.Bencode(out))
+	n, err := o.Bencode(out)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, len(in), n)
 	assert.Equal(t, in, out.String())
 }
 
@@ -41,7 +46,9 @@ func TestParseInt(t *testing.T) {
 	objAssertInt(t, 123, o)
 
 	out := bytes.NewBufferString("")
-	assert.Equal(t, len(in), o.Bencode(out))
+	n, err := o.Bencode(out)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, len(in), n)
 	assert.Equal(t, in, out.String())
 }
 
@@ -62,7 +69,9 @@ func TestParseList(t *testing.T) {
 	objAssertInt(t, 789, list[2])
 
 	out := bytes.NewBufferString("")
-	assert.Equal(t, len(in), o.Bencode(out))
+	n, err := o.Bencode(out)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, len(in), n)
 	assert.Equal(t, in, out.String())
 }
 
@@ -81,8 +90,12 @@ func TestParseMap(t *testing.T) {
 	objAssertStr(t, "patrick", dict["name"])
 	objAssertInt(t, 22, dict["age"])
 
+	// key按原始byte排序写入
 	out := bytes.NewBufferString("")
-	assert.Equal(t, len(in), o.Bencode(out))
+	n, err := o.Bencode(out)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, len(in), n)
+	assert.Equal(t, "d3:agei22e4:name7:patricke", out.String())
 }
 
 func TestParseComMap(t *testing.T) {
@@ -99,3 +112,214 @@ func TestParseComMap(t *testing.T) {
 	assert.Equal(t, BDICT, dict["user"].type_)
 	assert.Equal(t, BLIST, dict["value"].type_)
 }
+
+func TestParseStrict(t *testing.T) {
+	// 排序之后再编码，多次的结果相同
+	in := "d1:bi1e1:ai2e2:aai3e1:Bi4ee"
+	o, err := Parse(bytes.NewBufferString(in))
+	assert.Equal(t, nil, err)
+	for i := 0; i < 5; i++ {
+		out := new(bytes.Buffer)
+		_, err = o.Bencode(out)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, "d1:Bi4e1:ai2e2:aai3e1:bi1ee", out.String())
+	}
+
+	_, err = ParseStrict(bytes.NewBufferString(in))
+	assert.True(t, errors.Is(err, ErrKeyOrder))
+	_, err = ParseStrict(bytes.NewBufferString("d1:ai1e1:ai2ee"))
+	assert.True(t, errors.Is(err, ErrKeyDup))
+	// 嵌套的dict也要检查
+	_, err = ParseStrict(bytes.NewBufferString("ld1:bi1e1:ai2eee"))
+	assert.True(t, errors.Is(err, ErrKeyOrder))
+	o, err = ParseStrict(bytes.NewBufferString("d1:Bi4e1:ai2e2:aai3e1:bi1ee"))
+	assert.Equal(t, nil, err)
+	dict, _ := o.Dict()
+	assert.Equal(t, 4, len(dict))
+
+	// 非严格模式下重复的key以后面的为准
+	o, err = Parse(bytes.NewBufferString("d1:ai1e1:ai2ee"))
+	assert.Equal(t, nil, err)
+	dict, _ = o.Dict()
+	objAssertInt(t, 2, dict["a"])
+}
+
+func TestParseSyntaxError(t *testing.T) {
+	in := "d4:infod5:filesld6:lengthi1eed6:lengthi2xeeee"
+	_, err := Parse(bytes.NewBufferString(in))
+	var se *SyntaxError
+	assert.True(t, errors.As(err, &se))
+	assert.Equal(t, ErrEpE, se.Err)
+	assert.Equal(t, "info.files[1].length", se.Path)
+	// i2之后的x是出错的位置
+	assert.Equal(t, int64(strings.Index(in, "x")), se.Offset)
+	assert.Equal(t, "expect char e at offset 40 in info.files[1].length", err.Error())
+
+	_, err = Parse(bytes.NewBufferString("l1:a3:ab"))
+	assert.True(t, errors.As(err, &se))
+	assert.True(t, errors.Is(err, io.ErrUnexpectedEOF))
+	assert.Equal(t, "[1]", se.Path)
+
+	_, err = Parse(bytes.NewBufferString("lli1ex"))
+	assert.True(t, errors.As(err, &se))
+	assert.Equal(t, ErrIvd, se.Err)
+	assert.Equal(t, "[0][1]", se.Path)
+	assert.Equal(t, int64(5), se.Offset)
+}
+
+func TestParseStrictInt(t *testing.T) {
+	_, err := Parse(bytes.NewBufferString("d1:ai03ee"))
+	var se *SyntaxError
+	assert.True(t, errors.As(err, &se))
+	assert.Equal(t, ErrInt, se.Err)
+	assert.Equal(t, "a", se.Path)
+
+	_, err = Parse(bytes.NewBufferString("l-3:abce"))
+	assert.True(t, errors.Is(err, ErrIvd))
+}
+
+func TestParseBytes(t *testing.T) {
+	for _, in := range []string{
+		"3:abc", "0:", "i-42e", "i123456789012345678901234567890e", "le",
+		"l4:spami42ee", "d3:bar4:spam3:fooi42ee", "d4:infod6:lengthi3e4:name1:aee",
+	} {
+		o, err := ParseBytes([]byte(in))
+		assert.Equal(t, nil, err, in)
+		expect, _ := Parse(bytes.NewBufferString(in))
+		assert.Equal(t, expect, o, in)
+
+		out := new(bytes.Buffer)
+		n, err := o.Bencode(out)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, len(in), n)
+		assert.Equal(t, in, out.String())
+	}
+}
+
+func TestParseBytesZeroCopy(t *testing.T) {
+	data := []byte("d6:pieces4:abcde")
+	o, err := ParseBytes(data)
+	assert.Equal(t, nil, err)
+	dict, _ := o.Dict()
+	pieces, err := dict["pieces"].Bytes()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []byte("abcd"), pieces)
+
+	// 引用的是输入的buffer
+	data[11] = 'x'
+	assert.Equal(t, []byte("xbcd"), pieces)
+	// append不会覆盖输入中后面的数据
+	_ = append(pieces, 'z')
+	assert.Equal(t, byte('e'), data[15])
+}
+
+func TestParseBytesError(t *testing.T) {
+	var se *SyntaxError
+	_, err := ParseBytes([]byte("i1ei2e"))
+	assert.True(t, errors.As(err, &se))
+	assert.Equal(t, ErrIvd, se.Err)
+	assert.Equal(t, int64(3), se.Offset)
+
+	in := "d4:infod5:filesld6:lengthi1eed6:lengthi2xeeee"
+	_, err = ParseBytes([]byte(in))
+	assert.True(t, errors.As(err, &se))
+	assert.Equal(t, ErrEpE, se.Err)
+	assert.Equal(t, "info.files[1].length", se.Path)
+	assert.Equal(t, int64(strings.Index(in, "x")), se.Offset)
+
+	for _, in := range []string{"", "l", "5:abc", "i12", "d3:foo"} {
+		_, err = ParseBytes([]byte(in))
+		assert.True(t, errors.Is(err, io.ErrUnexpectedEOF), in)
+	}
+	for _, in := range []string{"i03e", "i-0e", "ie"} {
+		_, err = ParseBytes([]byte(in))
+		assert.True(t, errors.Is(err, ErrInt), in)
+	}
+}
+
+func TestParseBytesLimits(t *testing.T) {
+	// 默认限制嵌套的层数，恶意的输入不会耗尽栈
+	deep := []byte(strings.Repeat("l", 1<<20))
+	_, err := ParseBytes(deep)
+	assert.True(t, errors.Is(err, ErrDepth))
+	_, err = ParseBytes([]byte(strings.Repeat("l", DefaultMaxDepth+1) + strings.Repeat("e", DefaultMaxDepth+1)))
+	assert.Equal(t, nil, err)
+
+	_, err = ParseBytesWith([]byte("lli1eee"), ParseOptions{MaxDepth: 2})
+	assert.Equal(t, nil, err)
+	_, err = ParseBytesWith([]byte("llli1eeee"), ParseOptions{MaxDepth: 2})
+	assert.True(t, errors.Is(err, ErrDepth))
+
+	// 严格模式和Decoder相同
+	_, err = ParseBytes([]byte("d1:bi1e1:ai2ee"))
+	assert.Equal(t, nil, err)
+	var se *SyntaxError
+	_, err = ParseBytesWith([]byte("d1:bi1e1:ai2ee"), ParseOptions{Strict: true})
+	assert.True(t, errors.As(err, &se))
+	assert.Equal(t, ErrKeyOrder, se.Err)
+	assert.Equal(t, "a", se.Path)
+	assert.Equal(t, int64(7), se.Offset)
+	_, err = ParseBytesWith([]byte("d4:infod1:ai1e1:ai2eee"), ParseOptions{Strict: true})
+	assert.True(t, errors.As(err, &se))
+	assert.Equal(t, ErrKeyDup, se.Err)
+	assert.Equal(t, "info.a", se.Path)
+}
+
+// 一个pieces约为5MB的torrent文件
+func benchTorrent() []byte {
+	pieces := make([]byte, 20*256*1024)
+	for i := range pieces {
+		pieces[i] = byte(i * 7)
+	}
+	buf := new(bytes.Buffer)
+	buf.WriteString("d8:announce41:http://bttracker.debian.org:6969/announce4:infod")
+	buf.WriteString("6:lengthi396361728e4:name31:debian-11.2.0-amd64-netinst.iso12:piece lengthi262144e6:pieces")
+	EncodeString(buf, string(pieces))
+	buf.WriteString("ee")
+	return buf.Bytes()
+}
+
+// DHT中常见的find_node请求
+var benchKRPC = []byte("d1:ad2:id20:abcdefghij01234567896:target20:mnopqrstuvwxyz123456e1:q9:find_node1:t2:aa1:y1:qe")
+
+func BenchmarkParseTorrent(b *testing.B) {
+	data := benchTorrent()
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := Parse(bytes.NewReader(data)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParseBytesTorrent(b *testing.B) {
+	data := benchTorrent()
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := ParseBytes(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParseKRPC(b *testing.B) {
+	b.SetBytes(int64(len(benchKRPC)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := Parse(bytes.NewReader(benchKRPC)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParseBytesKRPC(b *testing.B) {
+	b.SetBytes(int64(len(benchKRPC)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := ParseBytes(benchKRPC); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package bencode
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+)
+
+var (
+	ErrDepth  = errors.New("nesting too deep")
+	ErrStrLen = errors.New("string too long")
+)
+
+// 从一个流中依次读取多个bencode的值，和encoding/json中的Decoder类似
+// 内部的缓冲在多次Decode之间保留，同一个连接上连续的消息不会丢失数据
+type Decoder struct {
+	r         *bufio.Reader
+	strict    bool
+	maxDepth  int   // list和dict嵌套的最大层数，为0时不限制
+	maxStrLen int   // 字符串的最大长度，为0时不限制
+	off       int64 // 已经读取的byte数，用于SyntaxError中的Offset
+}
+
+// r已经是*bufio.Reader时直接使用，否则包装一层
+func NewDecoder(r io.Reader) *Decoder {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &Decoder{r: br}
+}
+
+// 严格模式下dict的key必须按原始byte排序并且不能重复
+func (d *Decoder) SetStrict(strict bool) {
+	d.strict = strict
+}
+
+// 超过n层嵌套时返回ErrDepth，为0时不限制
+func (d *Decoder) SetMaxDepth(n int) {
+	d.maxDepth = n
+}
+
+// 字符串的长度超过n时返回ErrStrLen，在分配内存之前检查，为0时不限制
+func (d *Decoder) SetMaxStringLen(n int) {
+	d.maxStrLen = n
+}
+
+// 读取下一个值，流已经结束时返回io.EOF
+func (d *Decoder) DecodeObject() (*BObject, error) {
+	return d.parse(0)
+}
+
+// 读取下一个值并写入v，v的要求和Unmarshal相同
+func (d *Decoder) Decode(v interface{}) error {
+	o, err := d.DecodeObject()
+	if err != nil {
+		return err
+	}
+	return unmarshalObject(o, v)
+}
+
+// 当前位置相对于流开始的偏移，即所有已经解析的值的长度之和
+func (d *Decoder) InputOffset() int64 {
+	return d.off
+}
+
+// 缓冲中还没有被Decode读取的数据
+func (d *Decoder) Buffered() io.Reader {
+	buf, _ := d.r.Peek(d.r.Buffered())
+	return bytes.NewReader(buf)
+}
+
+// 向一个流中依次写入多个bencode的值
+type Encoder struct {
+	w         io.Writer
+	maxDepth  int
+	maxStrLen int
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+// 超过n层嵌套时返回ErrDepth，为0时不限制
+func (e *Encoder) SetMaxDepth(n int) {
+	e.maxDepth = n
+}
+
+// 字符串的长度超过n时返回ErrStrLen，为0时不限制
+func (e *Encoder) SetMaxStringLen(n int) {
+	e.maxStrLen = n
+}
+
+// 将v编码之后一次写入，出错时不会写入任何数据，v的要求和Marshal相同
+func (e *Encoder) Encode(v interface{}) error {
+	es := &encodeState{maxDepth: e.maxDepth, maxStrLen: e.maxStrLen}
+	es.marshal(v)
+	if es.err != nil {
+		return es.err
+	}
+	_, err := e.w.Write(es.Bytes())
+	return err
+}
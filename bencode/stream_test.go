@@ -0,0 +1,118 @@
+package bencode
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecoderStream(t *testing.T) {
+	in := "d3:agei20e4:name7:patricke" + "d3:agei31e4:name5:nancye" + "i7e"
+	d := NewDecoder(bytes.NewBufferString(in))
+
+	var u User
+	err := d.Decode(&u)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, User{Name: "patrick", Age: 20}, u)
+
+	err = d.Decode(&u)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, User{Name: "nancy", Age: 31}, u)
+
+	o, err := d.DecodeObject()
+	assert.Equal(t, nil, err)
+	objAssertInt(t, 7, o)
+
+	_, err = d.DecodeObject()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestDecoderTruncated(t *testing.T) {
+	d := NewDecoder(bytes.NewBufferString("i7el3:abc"))
+	o, err := d.DecodeObject()
+	assert.Equal(t, nil, err)
+	objAssertInt(t, 7, o)
+
+	// 值读到一半时流结束不是正常的结束
+	_, err = d.DecodeObject()
+	assert.True(t, errors.Is(err, io.ErrUnexpectedEOF))
+}
+
+func TestDecoderBuffered(t *testing.T) {
+	d := NewDecoder(bytes.NewBufferString("3:abcrest"))
+	o, err := d.DecodeObject()
+	assert.Equal(t, nil, err)
+	objAssertStr(t, "abc", o)
+
+	rest, _ := io.ReadAll(d.Buffered())
+	assert.Equal(t, "rest", string(rest))
+}
+
+func TestDecoderMaxDepth(t *testing.T) {
+	d := NewDecoder(bytes.NewBufferString("lli1eee"))
+	d.SetMaxDepth(2)
+	_, err := d.DecodeObject()
+	assert.Equal(t, nil, err)
+
+	d = NewDecoder(bytes.NewBufferString("llli1eeee"))
+	d.SetMaxDepth(2)
+	_, err = d.DecodeObject()
+	assert.True(t, errors.Is(err, ErrDepth))
+}
+
+func TestDecoderMaxStringLen(t *testing.T) {
+	d := NewDecoder(bytes.NewBufferString("l3:abce"))
+	d.SetMaxStringLen(3)
+	_, err := d.DecodeObject()
+	assert.Equal(t, nil, err)
+
+	// 长度在读取内容之前就已经被拒绝，不会分配这么大的内存
+	d = NewDecoder(bytes.NewBufferString("l999999999999:abce"))
+	d.SetMaxStringLen(3)
+	_, err = d.DecodeObject()
+	assert.True(t, errors.Is(err, ErrStrLen))
+}
+
+func TestEncoderStream(t *testing.T) {
+	buf := new(bytes.Buffer)
+	e := NewEncoder(buf)
+	assert.Equal(t, nil, e.Encode(User{Name: "patrick", Age: 20}))
+	assert.Equal(t, nil, e.Encode([]int{1, 2}))
+	assert.Equal(t, "d3:agei20e4:name7:patricke"+"li1ei2ee", buf.String())
+
+	// 写出去的数据可以被Decoder依次读回
+	d := NewDecoder(buf)
+	var u User
+	assert.Equal(t, nil, d.Decode(&u))
+	assert.Equal(t, User{Name: "patrick", Age: 20}, u)
+	var l []int
+	assert.Equal(t, nil, d.Decode(&l))
+	assert.Equal(t, []int{1, 2}, l)
+}
+
+func TestEncoderObject(t *testing.T) {
+	o, err := Parse(bytes.NewBufferString("d1:bi1e1:al1:xee"))
+	assert.Equal(t, nil, err)
+
+	buf := new(bytes.Buffer)
+	assert.Equal(t, nil, NewEncoder(buf).Encode(o))
+	assert.Equal(t, "d1:al1:xe1:bi1ee", buf.String())
+}
+
+func TestEncoderLimits(t *testing.T) {
+	buf := new(bytes.Buffer)
+	e := NewEncoder(buf)
+	e.SetMaxDepth(1)
+	assert.Equal(t, ErrDepth, e.Encode(Team{Name: "ace", Member: []User{{Name: "patrick"}}}))
+	// 出错时不写入任何数据
+	assert.Equal(t, 0, buf.Len())
+
+	e = NewEncoder(buf)
+	e.SetMaxStringLen(4)
+	assert.Equal(t, ErrStrLen, e.Encode(User{Name: "patrick"}))
+	assert.Equal(t, nil, e.Encode(User{Name: "pat"}))
+	assert.Equal(t, "d3:agei0e4:name3:pate", buf.String())
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/patrickhao/go-torrent/bencode"
+)
+
+// dump子命令，以缩进的树打印任意bencode文件，没有指定文件或者文件为-时从标准输入读取
+func runDump(args []string) error {
+	fs := flag.NewFlagSet("dump", flag.ExitOnError)
+	query := fs.String("q", "", "only print the value at path, e.g. info.files[0].length")
+	asJSON := fs.Bool("json", false, "print as json instead of a tree")
+	useBase64 := fs.Bool("base64", false, "encode binary strings as base64 instead of hex in json")
+	max := fs.Int("max", 64, "summarise strings longer than max bytes, 0 to print everything")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: main dump [-q path] [-json] [-base64] [-max n] [file]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	var r io.Reader = os.Stdin
+	if fs.NArg() > 0 && fs.Arg(0) != "-" {
+		file, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		r = file
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	o, err := bencode.ParseBytes(data)
+	if err != nil {
+		return err
+	}
+	if *query != "" {
+		o, err = o.Lookup(*query)
+		if err != nil {
+			return err
+		}
+	}
+
+	if *asJSON {
+		enc := bencode.BinaryHex
+		if *useBase64 {
+			enc = bencode.BinaryBase64
+		}
+		js, err := bencode.ToJSON(o, enc)
+		if err != nil {
+			return err
+		}
+		out := new(bytes.Buffer)
+		if err := json.Indent(out, js, "", "  "); err != nil {
+			return err
+		}
+		fmt.Println(out.String())
+		return nil
+	}
+	printTree(os.Stdout, o, "", "", *max)
+	return nil
+}
+
+// key是o所在dict的key，用于识别pieces这样的字段
+func printTree(w io.Writer, o *bencode.BObject, key string, indent string, max int) {
+	switch o.Type() {
+	case bencode.BSTR:
+		str, _ := o.Bytes()
+		fmt.Fprintln(w, formatString(str, key, max))
+	case bencode.BINT:
+		if val, err := o.Int64(); err == nil {
+			fmt.Fprintln(w, val)
+		} else {
+			val, _ := o.BigInt()
+			fmt.Fprintln(w, val)
+		}
+	case bencode.BLIST:
+		list, _ := o.List()
+		if len(list) == 0 {
+			fmt.Fprintln(w, "[]")
+			return
+		}
+		fmt.Fprintln(w, "[")
+		for _, elem := range list {
+			fmt.Fprint(w, indent+"  ")
+			printTree(w, elem, "", indent+"  ", max)
+		}
+		fmt.Fprintln(w, indent+"]")
+	case bencode.BDICT:
+		dict, _ := o.Dict()
+		if len(dict) == 0 {
+			fmt.Fprintln(w, "{}")
+			return
+		}
+		keys := make([]string, 0, len(dict))
+		for k := range dict {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		fmt.Fprintln(w, "{")
+		for _, k := range keys {
+			fmt.Fprintf(w, "%s  %s: ", indent, formatString([]byte(k), "", max))
+			printTree(w, dict[k], k, indent+"  ", max)
+		}
+		fmt.Fprintln(w, indent+"}")
+	}
+}
+
+// 可以打印的字符串加上引号，过长的只打印开头
+// 二进制的字符串只打印长度和开头的一部分hex，pieces还会打印piece的个数
+func formatString(str []byte, key string, max int) string {
+	if utf8.Valid(str) && strings.IndexFunc(string(str), isControl) < 0 {
+		if max <= 0 || len(str) <= max {
+			return strconv.Quote(string(str))
+		}
+		// 不能从一个字符的中间截断
+		cut := max
+		for cut > 0 && !utf8.RuneStart(str[cut]) {
+			cut--
+		}
+		return fmt.Sprintf("%s... (%d bytes)", strconv.Quote(string(str[:cut])), len(str))
+	}
+
+	size := fmt.Sprintf("%d bytes", len(str))
+	if key == "pieces" && len(str)%20 == 0 {
+		size = fmt.Sprintf("%d bytes, %d pieces", len(str), len(str)/20)
+	}
+	show := len(str)
+	if max > 0 && show > max/2 {
+		show = max / 2
+	}
+	if show < len(str) {
+		return fmt.Sprintf("<%s> %s...", size, hex.EncodeToString(str[:show]))
+	}
+	return fmt.Sprintf("<%s> %s", size, hex.EncodeToString(str))
+}
+
+func isControl(r rune) bool {
+	return r < ' ' && r != '\t' && r != '\n' || r == 0x7f
+}
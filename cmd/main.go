@@ -2,16 +2,48 @@ package main
 
 import (
 	"bufio"
-	"crypto/rand"
+	"context"
+	"encoding/hex"
+	"flag"
 	"fmt"
+	"net/http"
 	"os"
+	"os/signal"
 
 	"github.com/patrickhao/go-torrent/torrent"
 )
 
 func main() {
+	// dump子命令打印bencode文件的内容，不进行下载
+	if len(os.Args) > 1 && os.Args[1] == "dump" {
+		if err := runDump(os.Args[2:]); err != nil {
+			fmt.Println("dump error: " + err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
+	// 指定了http地址时，下载过程中同时通过http提供文件，支持Range请求
+	httpAddr := flag.String("http", "", "serve the downloading file over http, e.g. :8080")
+	downRate := flag.Int("down", 0, "download rate limit in bytes/s, 0 for unlimited")
+	upRate := flag.Int("up", 0, "upload rate limit in bytes/s, 0 for unlimited")
+	encrypt := flag.String("encrypt", "disable", "peer encryption policy: disable, prefer or require")
+	flag.Parse()
+	if flag.NArg() < 1 {
+		fmt.Println("usage: main [-http addr] [-down rate] [-up rate] [-encrypt policy] file.torrent")
+		fmt.Println("       main dump [-q path] [-json] [-base64] [-max n] [file]")
+		return
+	}
+	policy, err := torrent.ParseEncryptionPolicy(*encrypt)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	torrent.DownloadLimit.SetLimit(*downRate)
+	torrent.UploadLimit.SetLimit(*upRate)
+
 	// parse torrent file
-	file, err := os.Open(os.Args[1])
+	file, err := os.Open(flag.Arg(0))
 	if err != nil {
 		fmt.Println("open file error")
 		return
@@ -24,29 +56,86 @@ func main() {
 		return
 	}
 
-	// random peerId
-	// 随机生成当前客户端的一些信息
-	var peerId [torrent.IDLEN]byte
-	_, _ = rand.Read(peerId[:])
+	// 前缀表示当前客户端和版本，之后是随机的部分
+	peerId, err := torrent.NewPeerID(torrent.DefaultPeerIDPrefix)
+	if err != nil {
+		fmt.Println("generate peer id error: " + err.Error())
+		return
+	}
+
+	// build torrent task
+	task := &torrent.TorrentTask{
+		PeerId:     peerId,
+		InfoSHA:    tf.InfoSHA,
+		FileName:   tf.FileName,
+		FileLen:    tf.FileLen,
+		PieceLen:   tf.PieceLen,
+		PieceSHA:   tf.PieceSHA,
+		Announce:   tf.Announce,
+		Observer:   torrent.ObserverFunc(printEvent),
+		Encryption: policy,
+	}
+
+	// Ctrl-C时取消下载，关闭所有peer连接
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
 
 	// connect tracker & find peers
-	peers := torrent.FindPeers(tf, peerId)
+	peers, _ := task.FindPeers(ctx)
 	if (len(peers)) == 0 {
 		fmt.Println("can not find peers")
 		return
 	}
+	task.AddPeers(peers...)
 
-	// build torrent task
-	task := &torrent.TorrentTask{
-		PeerId:   peerId,
-		PeerList: peers,
-		InfoSHA:  tf.InfoSHA,
-		FileName: tf.FileName,
-		FileLen:  tf.FileLen,
-		PieceLen: tf.PieceLen,
-		PieceSHA: tf.PieceSHA,
+	// serve file over http while downloading
+	serveErr := make(chan error, 1)
+	if *httpAddr != "" {
+		srv := torrent.NewServer()
+		srv.Add(task)
+		fmt.Printf("serving http://%s/torrents/%s/%s\n", *httpAddr, hex.EncodeToString(tf.InfoSHA[:]), tf.FileName)
+		go func() {
+			serveErr <- http.ListenAndServe(*httpAddr, srv)
+		}()
 	}
 
 	// download from peers & make file
-	torrent.Download(task)
+	fmt.Println("start downloading " + task.FileName)
+	err = torrent.Download(ctx, task)
+	if err != nil {
+		fmt.Println("download error: " + err.Error())
+		return
+	}
+
+	// 下载完成后继续提供http服务
+	if *httpAddr != "" {
+		fmt.Println("http server error: " + (<-serveErr).Error())
+	}
+}
+
+// 命令行中只打印下载过程中的事件，库本身不做任何输出
+func printEvent(e torrent.Event) {
+	switch e.Type {
+	case torrent.EventAnnounce:
+		if e.Err != nil {
+			fmt.Println("fail to connect to tracker: " + e.Err.Error())
+			return
+		}
+		fmt.Printf("tracker returned %d peers\n", e.Peers)
+	case torrent.EventPeerConnected:
+		fmt.Printf("complete handshake with peer: %s (%s)\n", e.Peer.Ip, e.Client)
+	case torrent.EventPeerDisconnected:
+		if e.Err != nil {
+			fmt.Printf("peer %s disconnected: %v\n", e.Peer.Ip, e.Err)
+		}
+	case torrent.EventPeerBanned:
+		fmt.Printf("banned peer %s: %v\n", e.Peer.Ip, e.Err)
+	case torrent.EventPieceFailed:
+		fmt.Printf("fail to download piece %d from %s: %v\n", e.Index, e.Peer.Ip, e.Err)
+	case torrent.EventPieceVerified:
+		percent := float64(e.Done) / float64(e.Total) * 100
+		fmt.Printf("downloading, progress: (%0.2f%%)\n", percent)
+	case torrent.EventComplete:
+		fmt.Println("download complete")
+	}
 }
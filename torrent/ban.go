@@ -0,0 +1,151 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"errors"
+	"net"
+	"sync"
+)
+
+var ErrPeerBanned = errors.New("peer banned")
+
+// 提供的数据导致piece校验失败多少次之后ban掉对方的IP
+const MaxStrikes = 3
+
+// ban的原因，strike累计导致的ban在之后证明数据正确时可以撤销，确认发送了错误数据的不能撤销
+type banReason int
+
+const (
+	banStrikes banReason = iota + 1
+	banProven
+)
+
+// 按IP记录的strike和ban，在Session中运行时所有任务共享
+type banList struct {
+	mu      sync.Mutex
+	strikes map[string]int
+	banned  map[string]banReason
+	notify  chan struct{} // 有peer等待时不为nil，有新的IP被ban时关闭
+}
+
+func newBanList() *banList {
+	return &banList{
+		strikes: make(map[string]int),
+		banned:  make(map[string]banReason),
+	}
+}
+
+// 记一次strike，达到MaxStrikes时ban掉，返回是否因此被ban
+func (b *banList) strike(ip string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.banned[ip] != 0 {
+		return false
+	}
+	b.strikes[ip]++
+	if b.strikes[ip] < MaxStrikes {
+		return false
+	}
+	b.banLocked(ip, banStrikes)
+	return true
+}
+
+// 撤销一次strike，对方提供的数据后来证明是正确的
+// 因为strike达到MaxStrikes被ban的同时解除ban
+func (b *banList) forgive(ip string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.banned[ip] == banStrikes {
+		delete(b.banned, ip)
+	}
+	if b.strikes[ip] > 0 {
+		b.strikes[ip]--
+	}
+}
+
+// 确认发送了错误的数据，直接ban掉并且不能撤销，返回是否是新ban的
+func (b *banList) ban(ip string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.banned[ip] != 0 {
+		b.banned[ip] = banProven
+		return false
+	}
+	b.banLocked(ip, banProven)
+	return true
+}
+
+func (b *banList) banLocked(ip string, reason banReason) {
+	b.banned[ip] = reason
+	if b.notify != nil {
+		close(b.notify)
+		b.notify = nil
+	}
+}
+
+// ip是否被ban，以及有新的IP被ban时会被关闭的channel
+func (b *banList) check(ip string) (<-chan struct{}, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.banned[ip] != 0 {
+		return nil, true
+	}
+	if b.notify == nil {
+		b.notify = make(chan struct{})
+	}
+	return b.notify, false
+}
+
+func (b *banList) isBanned(ip string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.banned[ip] != 0
+}
+
+// 对方的IP是否因为发送错误的数据被ban
+func (t *TorrentTask) IsBanned(ip net.IP) bool {
+	t.init()
+	return t.bans.isBanned(ip.String())
+}
+
+// piece校验失败，记下每个peer提供的block的SHA，用于之后找出发送错误数据的peer
+// 每个提供了数据的peer记一次strike，然后清空数据从头下载
+func (t *TorrentTask) pieceFailed(task *pieceTask) {
+	attempt := make([]blockRecord, 0, len(task.blocks))
+	strikes := make(map[string]bool)
+	for _, b := range task.blocks {
+		b.sha = sha1.Sum(task.data[b.offset : b.offset+b.length])
+		attempt = append(attempt, b)
+		strikes[b.ip] = true
+	}
+	task.failed = append(task.failed, attempt)
+	task.data, task.blocks = nil, nil
+	for ip := range strikes {
+		if t.bans.strike(ip) {
+			t.emit(Event{Type: EventPeerBanned, Peer: PeerInfo{Ip: net.ParseIP(ip)}, Err: ErrPieceHash})
+		}
+	}
+}
+
+// piece校验通过，和之前每次失败时记录的block比较
+// 有block和正确的数据不同的peer直接ban掉，所有block都正确的peer撤销那一次的strike，strike导致的ban也随之解除
+func (t *TorrentTask) pieceVerified(task *pieceTask) {
+	for _, attempt := range task.failed {
+		bad := make(map[string]bool)
+		for _, b := range attempt {
+			if sha1.Sum(task.data[b.offset:b.offset+b.length]) != b.sha {
+				bad[b.ip] = true
+			} else if !bad[b.ip] {
+				bad[b.ip] = false
+			}
+		}
+		for ip, isBad := range bad {
+			if !isBad {
+				t.bans.forgive(ip)
+			} else if t.bans.ban(ip) {
+				t.emit(Event{Type: EventPeerBanned, Peer: PeerInfo{Ip: net.ParseIP(ip)}, Err: ErrPieceHash})
+			}
+		}
+	}
+	task.failed = nil
+}
@@ -0,0 +1,147 @@
+package torrent
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"net"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBanListStrikes(t *testing.T) {
+	b := newBanList()
+	wait, banned := b.check("1.2.3.4")
+	assert.False(t, banned)
+	for i := 1; i < MaxStrikes; i++ {
+		assert.False(t, b.strike("1.2.3.4"))
+	}
+	// 撤销之后还要再记一次才会被ban
+	b.forgive("1.2.3.4")
+	assert.False(t, b.strike("1.2.3.4"))
+	assert.True(t, b.strike("1.2.3.4"))
+	<-wait
+	_, banned = b.check("1.2.3.4")
+	assert.True(t, banned)
+	assert.False(t, b.ban("1.2.3.4"))
+	assert.False(t, b.isBanned("5.6.7.8"))
+}
+
+func TestBanListForgive(t *testing.T) {
+	b := newBanList()
+	for i := 0; i < MaxStrikes; i++ {
+		b.strike("1.2.3.4")
+	}
+	assert.True(t, b.isBanned("1.2.3.4"))
+	// strike导致的ban在撤销strike时解除，再记一次strike又会被ban
+	b.forgive("1.2.3.4")
+	assert.False(t, b.isBanned("1.2.3.4"))
+	assert.True(t, b.strike("1.2.3.4"))
+
+	// 确认发送了错误数据的ban不能撤销
+	assert.False(t, b.ban("1.2.3.4"))
+	b.forgive("1.2.3.4")
+	assert.True(t, b.isBanned("1.2.3.4"))
+	assert.True(t, b.ban("5.6.7.8"))
+	b.forgive("5.6.7.8")
+	assert.True(t, b.isBanned("5.6.7.8"))
+}
+
+func TestSmartBan(t *testing.T) {
+	good := []byte("0123456789")
+	bad := []byte("01234x6789")
+	task := newTestTask(t, nil)
+	task.init()
+	piece := &pieceTask{index: 0, sha: sha1.Sum(good), length: len(good)}
+
+	// 两个peer各提供了一半，其中一个的数据是错的
+	piece.data = append([]byte(nil), bad...)
+	piece.blocks = map[int]blockRecord{
+		0: {offset: 0, length: 5, ip: "10.0.0.1"},
+		5: {offset: 5, length: 5, ip: "10.0.0.2"},
+	}
+	task.pieceFailed(piece)
+	assert.Nil(t, piece.data)
+	assert.Equal(t, 1, task.bans.strikes["10.0.0.1"])
+	assert.Equal(t, 1, task.bans.strikes["10.0.0.2"])
+
+	// 从第三个peer重新下载，校验通过之后找出发送错误数据的peer
+	piece.data = append([]byte(nil), good...)
+	task.pieceVerified(piece)
+	assert.True(t, task.IsBanned(net.ParseIP("10.0.0.2")))
+	assert.False(t, task.IsBanned(net.ParseIP("10.0.0.1")))
+	assert.Equal(t, 0, task.bans.strikes["10.0.0.1"])
+	assert.Nil(t, piece.failed)
+}
+
+func TestDownloadSmartBan(t *testing.T) {
+	data := make([]byte, 2*BLOCKSIZE)
+	rand.Read(data)
+	corrupt := append([]byte(nil), data...)
+	corrupt[0] ^= 0xff
+
+	// 127.0.0.2的peer发送错误的第一个block，然后拒绝第二个block
+	// 127.0.0.1的peer等它完成之后才开始提供数据
+	poisoned := make(chan struct{})
+	bad := listenPeerOn(t, "127.0.0.2", func(c *PeerConn) {
+		c.WriteMsg(&PeerMsg{MsgBitfield, []byte{0x80}})
+		c.WriteMsg(&PeerMsg{MsgUnchoke, nil})
+		for sent := false; ; {
+			msg, err := c.ReadMsg()
+			if err != nil {
+				return
+			}
+			if msg == nil || msg.Id != MsgRequest {
+				continue
+			}
+			if !sent {
+				sent = true
+				replyPiece(c, msg, corrupt)
+				continue
+			}
+			c.WriteMsg(&PeerMsg{MsgReject, msg.Payload})
+			close(poisoned)
+		}
+	})
+	good := listenPeer(t, func(c *PeerConn) {
+		c.WriteMsg(&PeerMsg{MsgHaveNone, nil})
+		<-poisoned
+		c.WriteMsg(NewHaveMsg(0))
+		c.WriteMsg(&PeerMsg{MsgUnchoke, nil})
+		for {
+			msg, err := c.ReadMsg()
+			if err != nil {
+				return
+			}
+			if msg != nil && msg.Id == MsgRequest {
+				replyPiece(c, msg, data)
+			}
+		}
+	})
+
+	task := newTestTask(t, []PeerInfo{bad, good})
+	task.FileLen = len(data)
+	task.PieceLen = len(data)
+	task.PieceSHA = [][SHALEN]byte{sha1.Sum(data)}
+	var mu sync.Mutex
+	var banned []string
+	task.Observer = ObserverFunc(func(e Event) {
+		if e.Type == EventPeerBanned {
+			mu.Lock()
+			defer mu.Unlock()
+			banned = append(banned, e.Peer.Ip.String())
+		}
+	})
+	assert.Equal(t, nil, Download(context.Background(), task))
+	got, _ := os.ReadFile(task.FileName)
+	assert.Equal(t, data, got)
+
+	// 两个peer的block混在一起校验失败，重新下载之后只ban掉发送错误数据的peer
+	assert.Equal(t, []string{"127.0.0.2"}, banned)
+	assert.True(t, task.IsBanned(bad.Ip))
+	assert.False(t, task.IsBanned(good.Ip))
+	assert.Equal(t, 0, task.bans.strikes["127.0.0.1"])
+}
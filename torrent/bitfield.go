@@ -2,6 +2,17 @@ package torrent
 
 import "strconv"
 
+// 检查对方发来的bitfield，长度必须正好是numPieces个bit，多出来的bit必须为0
+func checkBitfield(field Bitfield, numPieces int) error {
+	if len(field) != (numPieces+7)/8 {
+		return protocolErr("bitfield", "expected length %d, got %d", (numPieces+7)/8, len(field))
+	}
+	if spare := len(field)*8 - numPieces; spare > 0 && field[len(field)-1]&(1<<spare-1) != 0 {
+		return protocolErr("bitfield", "spare bits are set")
+	}
+	return nil
+}
+
 type Bitfield []byte
 
 // Bitfield中的方法，不一定传入的要是指针
@@ -2,12 +2,25 @@ package torrent
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+var (
+	ErrNoPeers        = errors.New("no peers left")
+	ErrAllPeersFailed = errors.New("all peers failed")
+	ErrStorage        = errors.New("storage error")
+	// 对方没有choke却拒绝了请求，这个piece交给其他peer下载，连接不断开
+	ErrRequestRejected = errors.New("request rejected")
+)
+
 // 整个种子任务
 type TorrentTask struct {
 	PeerId   [IDLEN]byte
@@ -17,6 +30,44 @@ type TorrentTask struct {
 	FileLen  int
 	PieceLen int
 	PieceSHA [][SHALEN]byte
+	Announce string   // tracker的地址
+	Observer Observer // 接收下载过程中的事件，为nil时忽略所有事件
+
+	// 该任务的限速，和Session以及全局的限速同时生效，为nil时不限速
+	DownloadLimit *Limiter
+	UploadLimit   *Limiter
+
+	// 主动发起连接时的加密策略，在Session中运行时使用SessionConfig.Encryption
+	Encryption EncryptionPolicy
+	// 连接各个阶段的超时，为0的项使用DefaultTimeouts中的值
+	Timeouts Timeouts
+	// 同时连接的peer数量的上限，包括对方发起的连接，为0时使用DefaultMaxPeers
+	MaxPeers int
+	// 连接失败或者断开的peer的重试策略，为0的项使用DefaultRetry中的值
+	Retry RetryPolicy
+
+	once      sync.Once
+	queue     *pieceQueue
+	connected atomic.Int32    // 当前这次下载中成功建立过连接的peer数量
+	done      []chan struct{} // 每个piece校验通过并写入文件后关闭对应的channel，用于等待某个piece
+	incoming  chan *PeerConn  // 对方主动发起并完成握手的连接
+	bans      *banList        // 在Session中运行时由Session设置，所有任务共享
+	pool      *peerPool       // 可以连接的peer，PeerList和AddPeers加入的都在这里
+	file      *os.File        // Download期间打开的文件，用于回复对方的请求
+
+	// 校验通过的piece按完成的顺序记录下来，每个peer记住自己发送到了哪里，再向对方发送Have
+	haveMu     sync.Mutex
+	haves      []int
+	haveNotify chan struct{} // 有peer等待时不为nil，有新的piece时关闭
+
+	// 以下由Session设置，为零值时表示不限制
+	port  int           // 监听的端口，为0时使用PeerPort
+	conns chan struct{} // 连接数的信号量
+	disk  *diskPool
+	utp   *utpSocket // 监听端口上的uTP socket，主动发起的uTP连接也使用这个端口
+	down  *Limiter   // Session的限速
+	up    *Limiter
+	grace time.Duration // 没有peer时等待对方发起连接的时间，为0时表示不接收对方发起的连接
 }
 
 // 每一片的任务
@@ -24,17 +75,41 @@ type pieceTask struct {
 	index  int
 	sha    [SHALEN]byte
 	length int
+
+	// 已经收到的数据，换一个peer之后只请求剩下的block，offset -> 提供这个block的peer
+	data   []byte
+	blocks map[int]blockRecord
+	// 之前每次校验失败时各个peer提供的block，校验通过之后和正确的数据比较，找出发送错误数据的peer
+	failed [][]blockRecord
+}
+
+// 一个block来自哪个peer
+type blockRecord struct {
+	offset int
+	length int
+	ip     string
+	sha    [SHALEN]byte // 校验失败之后才计算
 }
 
 // 用来描述下载中间过程的结构体，是针对一个piece来说
 // 因为一个piece也挺长的
 type taskState struct {
 	index      int
-	conn       *PeerConn
-	requested  int // 表示请求了多少个byte
-	downloaded int // 表示已经下载了多少个byte，结合长度可以算出还有多个byte在路上
-	backlog    int // 并发度
-	data       []byte
+	requested  int         // 表示请求了多少个byte
+	downloaded int         // 表示已经下载了多少个byte，结合长度可以算出还有多个byte在路上
+	backlog    int         // 并发度
+	inflight   map[int]int // 已经发出还没有收到的请求，offset -> length
+	retry      []block     // 被拒绝或者因为choke被丢弃的请求，需要重新发送
+}
+
+type block struct {
+	offset int
+	length int
+}
+
+type peerExitMsg struct {
+	peer *poolPeer // 对方发起的连接为nil
+	err  error
 }
 
 type pieceResult struct {
@@ -48,148 +123,567 @@ const BLOCKSIZE = 16384
 // 最大的并发度，用来控制网络带宽的占用
 const MAXBACKLOG = 5
 
-func (state *taskState) handleMsg() error {
-	msg, err := state.conn.ReadMsg()
-	if err != nil {
-		return err
-	}
+// 和一个peer之间的状态机，由对方的消息、下载队列的变化和请求超时驱动
+// 所有方法都只在servePeer的go routine中调用，读写由PeerConn的读写循环完成，这里不会阻塞在网络上
+type peerState struct {
+	t       *TorrentTask
+	ctx     context.Context
+	conn    *PeerConn
+	results chan<- *pieceResult
+
+	task  *pieceTask // 正在下载的piece，为nil时空闲，从队列中取新的piece
+	piece *taskState
+
+	amChoking      bool // 是否choke对方，对方interested之后unchoke
+	peerInterested bool
+	amInterested   bool // 对方有我们没有的piece
+	haveSent       int  // 已经向对方发送过的TorrentTask.haves的数量
+}
 
-	// handle keep-alive
-	if msg == nil {
-		return nil
+// 处理对方的一条消息，返回错误时断开连接
+func (ps *peerState) handle(msg *PeerMsg) error {
+	conn := ps.conn
+	if msg.Id.fast() && !conn.fast {
+		return protocolErr(msg.Id.String(), "fast extension is not negotiated")
 	}
-
 	switch msg.Id {
 	case MsgChoke:
-		state.conn.Chocked = true
+		conn.Chocked = true
+		// 不支持fast extension时，对方choke之后会丢弃所有没有处理的请求，unchoke之后要重新请求
+		// 支持时对方会对每个丢弃的请求回复Reject
+		if ps.piece != nil && !conn.fast {
+			state := ps.piece
+			for offset, length := range state.inflight {
+				state.retry = append(state.retry, block{offset, length})
+			}
+			state.inflight = make(map[int]int)
+			state.backlog = 0
+		}
 	case MsgUnchoke:
-		state.conn.Chocked = false
+		conn.Chocked = false
+	case MsgInterested:
+		ps.peerInterested = true
+		// 没有choke算法，对方interested就开始上传
+		if ps.amChoking {
+			ps.amChoking = false
+			conn.Send(&PeerMsg{MsgUnchoke, nil})
+		}
+	case MsgNotInterested:
+		ps.peerInterested = false
 	case MsgHave:
 		index, err := GetHaveIndex(msg)
 		if err != nil {
 			return err
 		}
-		state.conn.Field.SetPiece(index)
+		if index >= len(ps.t.PieceSHA) {
+			return protocolErr(msg.Id.String(), "piece index %d out of range", index)
+		}
+		conn.Field.SetPiece(index)
+		ps.updateInterest()
+	case MsgRequest:
+		return ps.onRequest(msg)
+	case MsgCancel:
+		index, offset, length, err := GetRequestInfo(msg)
+		if err != nil {
+			return err
+		}
+		// 已经发出去的piece无法撤回，还在队列中的直接丢弃
+		// 支持fast extension时每个请求都要有回应，丢弃的请求回复Reject
+		if conn.unsend(index, offset, length) && conn.fast {
+			conn.Send(&PeerMsg{MsgReject, msg.Payload})
+		}
 	case MsgPiece:
-		// 将收到的数据拷贝到state的data中
-		// 这里的index用来做校验，保证传过来的数据的index是想要的那块piece
-		n, err := CopyPieceData(state.index, state.data, msg)
+		return ps.onPiece(msg)
+	case MsgReject:
+		return ps.onReject(msg)
+	case MsgAllowedFast:
+		index, err := GetFastIndex(msg)
 		if err != nil {
 			return err
 		}
-		state.downloaded += n
-		state.backlog--
+		if index >= len(ps.t.PieceSHA) {
+			return protocolErr(msg.Id.String(), "piece index %d out of range", index)
+		}
+		conn.allowedFast[index] = true
+	case MsgSuggest:
+		// 只是建议，可以忽略
+	case MsgBitfield, MsgHaveAll, MsgHaveNone:
+		// 只能作为握手之后的第一条消息，在fillBitfield中处理
+		return protocolErr(msg.Id.String(), "must be the first message")
 	}
 	return nil
 }
 
-func downloadPiece(conn *PeerConn, task *pieceTask) (*pieceResult, error) {
-	state := &taskState{
-		index: task.index,
-		conn:  conn,
-		data:  make([]byte, task.length),
-	}
-	conn.SetDeadline(time.Now().Add(15 * time.Second))
-	defer conn.SetDeadline(time.Time{})
-
-	// 对于当前piece来说，可能是分块下载的，每一次下载MAXBACKLOG个bytes
-	// 因此当所有的piece块都没下载完的时候要继续下载
-	for state.downloaded < task.length {
-		// 如果Chocked为false，表示愿意上传数据
-		if !conn.Chocked {
-			// 当前并发的数量小于上限，并且请求的数量小于piece的总长度
-			// 如果请求的数量大于piece的总长度了，就只需要等路上的都传回来即可
-			// 这里每个task只会被一个go routine取走，因此每个task最多只会将请求数量增加1
-			for state.backlog < MAXBACKLOG && state.requested < task.length {
-				length := BLOCKSIZE
-				// 对一个piece中的最后一段，可能长度会短一些，做一下特殊处理
-				if task.length-state.requested < length {
-					length = task.length - state.requested
-				}
+func (ps *peerState) onPiece(msg *PeerMsg) error {
+	state := ps.piece
+	// 放弃的piece，比如被拒绝之后换了别的piece，之前请求的数据仍然可能到达，直接丢掉
+	if state == nil || int(binary.BigEndian.Uint32(msg.Payload[0:4])) != state.index {
+		return nil
+	}
+	// 没有请求过的block，比如choke之前发出、已经放入retry的请求，不重复计算
+	// 这些block可能已经由别的peer提供了，不能覆盖
+	offset := int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+	length, ok := state.inflight[offset]
+	if !ok {
+		return nil
+	}
+	if len(msg.Payload)-8 != length {
+		return protocolErr(msg.Id.String(), "block at offset %d has length %d, requested %d", offset, len(msg.Payload)-8, length)
+	}
+	// 将收到的数据拷贝到task的data中，并记下是哪个peer提供的
+	n, err := CopyPieceData(state.index, ps.task.data, msg)
+	if err != nil {
+		return err
+	}
+	ps.task.blocks[offset] = blockRecord{offset: offset, length: n, ip: ps.conn.peer.Ip.String()}
+	delete(state.inflight, offset)
+	state.downloaded += n
+	state.backlog--
+	ps.t.emit(Event{Type: EventBytes, Index: state.index, Peer: ps.conn.peer, Bytes: n})
+	if state.downloaded < ps.task.length {
+		return nil
+	}
+	return ps.complete()
+}
 
-				// 新建一个request信息，告诉对方我要下这个piece的这个block了
-				// 因为这里是将一个piece分成块，并且按顺序下载piece的每个块
-				// 因此这里直接将requested的长度作为index即可
-				// requested表示已经申请的块，在满足并发度的条件下继续申请后续的新的块
-				// 感觉这里可以用滑动窗口来优化
-				msg := NewRequestMsg(state.index, state.requested, length)
-				_, err := state.conn.WriteMsg(msg)
-				if err != nil {
-					return nil, err
-				}
+func (ps *peerState) onReject(msg *PeerMsg) error {
+	index, offset, _, err := GetRejectInfo(msg)
+	if err != nil {
+		return err
+	}
+	state := ps.piece
+	if state == nil || index != state.index {
+		return nil
+	}
+	length, ok := state.inflight[offset]
+	if !ok {
+		return nil
+	}
+	delete(state.inflight, offset)
+	state.backlog--
+	// 被choke时拒绝的请求，等unchoke或者是allowed fast的piece时立即重新请求
+	// 没有被choke却被拒绝，说明对方不愿意提供这个piece，交给其他peer下载，连接不断开
+	if !ps.conn.Chocked {
+		ps.conn.rejected[index] = true
+		ps.abort(ErrRequestRejected)
+		return nil
+	}
+	state.retry = append(state.retry, block{offset, length})
+	return nil
+}
 
-				// 这里是串行的修改该值，不是多个go routine并发执行，不用考虑加锁
-				state.backlog++
-				state.requested += length
-			}
+// 回复对方的请求，choke对方或者我们没有这个piece时不回复，支持fast extension时回复Reject
+func (ps *peerState) onRequest(msg *PeerMsg) error {
+	index, offset, length, err := GetRequestInfo(msg)
+	if err != nil {
+		return err
+	}
+	if index >= len(ps.t.PieceSHA) {
+		return protocolErr(msg.Id.String(), "piece index %d out of range", index)
+	}
+	begin, end := ps.t.getPieceBounds(index)
+	if length == 0 || length > MaxBlockLen || offset+length > end-begin {
+		return protocolErr(msg.Id.String(), "invalid block offset %d length %d", offset, length)
+	}
+	if ps.amChoking || !ps.t.havePiece(index) {
+		if ps.conn.fast {
+			ps.conn.Send(&PeerMsg{MsgReject, msg.Payload})
 		}
+		return nil
+	}
 
-		// 发送了满足并发度的若干请求，等有数据回来，即ReadMsg()读到数据
-		// 对读到的数据进行处理，注意这里和上面的循环都在一个大的循环中
-		// 两者交替执行，一个不停的发请求，请求数量满足并发度，一个不停的读数据
-		// 然后处理完减少并发度，使得又可以发新的请求，在发请求和处理数据的时候有任何Error
-		// 都会返回，并将该piece的task放回队列中，等其他的peer处理
-		// 感觉这里可以用go routine优化
-		err := state.handleMsg()
-		if err != nil {
-			return nil, err
+	payload := make([]byte, 8+length)
+	copy(payload, msg.Payload[:8])
+	err = ps.t.readAt(payload[8:], int64(begin+offset))
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrStorage, err)
+	}
+	ps.conn.Send(&PeerMsg{MsgPiece, payload})
+	return nil
+}
+
+// 对方愿意上传这个piece，没有被choke或者这个piece是allowed fast的
+func (ps *peerState) canRequest() bool {
+	return !ps.conn.Chocked || ps.conn.allowedFast[ps.piece.index]
+}
+
+// 空闲时从队列中取出对方拥有的piece，然后在允许请求时补充请求直到达到并发度
+// 队列中没有对方拥有的piece时返回wait，队列有变化时被关闭，队列关闭时done为true
+func (ps *peerState) fill() (wait <-chan struct{}, done bool) {
+	if ps.task == nil {
+		task, changed, closed := ps.pop()
+		if task == nil {
+			return changed, closed
+		}
+		// 之前的peer已经下载了一部分时继续下载剩下的
+		if task.data == nil {
+			task.data = make([]byte, task.length)
+			task.blocks = make(map[int]blockRecord)
+		}
+		downloaded := 0
+		for _, b := range task.blocks {
+			downloaded += b.length
+		}
+		ps.task = task
+		ps.piece = &taskState{
+			index:      task.index,
+			downloaded: downloaded,
+			inflight:   make(map[int]int),
+		}
+	}
+
+	// 如果Chocked为false，表示愿意上传数据，allowed fast的piece被choke时也可以请求
+	if !ps.canRequest() {
+		return nil, false
+	}
+	// 当前并发的数量小于上限，并且还有没请求的block
+	// 如果所有block都请求过了，就只需要等路上的都传回来即可
+	state := ps.piece
+	for state.backlog < MAXBACKLOG {
+		// 按顺序请求piece的每个块，被拒绝或者被丢弃的块会重新请求
+		b, ok := state.nextBlock(ps.task)
+		if !ok {
+			break
+		}
+		ps.conn.Send(NewRequestMsg(state.index, b.offset, b.length))
+		state.inflight[b.offset] = b.length
+		state.backlog++
+	}
+	return nil, false
+}
+
+// 从队列中拿出对方拥有的task，对方没有的留在队列中等其他peer处理，对方拒绝过的piece不再向其请求
+// 被choke时优先下载allowed fast的piece，这些piece不需要等待unchoke
+func (ps *peerState) pop() (*pieceTask, <-chan struct{}, bool) {
+	conn := ps.conn
+	has := func(index int) bool {
+		return conn.Field.HasPiece(index) && !conn.rejected[index]
+	}
+	if conn.Chocked && len(conn.allowedFast) > 0 {
+		task, _, closed := ps.t.queue.poll(func(index int) bool {
+			return conn.allowedFast[index] && has(index)
+		})
+		if task != nil || closed {
+			return task, nil, closed
+		}
+	}
+	return ps.t.queue.poll(has)
+}
+
+// 当前piece下载完成，校验通过后交给Download写入文件
+func (ps *peerState) complete() error {
+	task, res := ps.task, &pieceResult{ps.task.index, ps.task.data}
+	ps.task, ps.piece = nil, nil
+	if !checkPiece(task, res) {
+		// 下下来校验不对，记下提供数据的peer，放回队列从头再下载
+		// 发送错误数据的peer被ban之后，由servePeer断开
+		ps.t.pieceFailed(task)
+		ps.t.queue.push(task)
+		ps.t.emit(Event{Type: EventPieceFailed, Index: task.index, Peer: ps.conn.peer, Err: ErrPieceHash})
+		return nil
+	}
+	ps.t.pieceVerified(task)
+	task.data, task.blocks = nil, nil
+	select {
+	case ps.results <- res:
+		return nil
+	case <-ps.ctx.Done():
+		return ps.ctx.Err()
+	}
+}
+
+// 放弃当前piece，放回队列，从其他peer处再下载
+func (ps *peerState) abort(err error) {
+	task := ps.task
+	ps.task, ps.piece = nil, nil
+	ps.t.queue.push(task)
+	// 取消时连接被关闭导致的错误不算piece下载失败
+	if ps.ctx.Err() == nil {
+		ps.t.emit(Event{Type: EventPieceFailed, Index: task.index, Peer: ps.conn.peer, Err: err})
+	}
+}
+
+// 向对方发送新完成的piece的Have，对方已经有的piece不发送，返回等待下一个piece完成的channel
+func (ps *peerState) announce() <-chan struct{} {
+	haves, wait := ps.t.havesSince(ps.haveSent)
+	ps.haveSent += len(haves)
+	for _, index := range haves {
+		if !ps.conn.Field.HasPiece(index) {
+			ps.conn.Send(NewHaveMsg(index))
+		}
+	}
+	if len(haves) > 0 {
+		ps.updateInterest()
+	}
+	return wait
+}
+
+// 对方有我们没有的piece时interested，否则not interested，状态变化时通知对方
+func (ps *peerState) updateInterest() {
+	want := false
+	for i := range ps.t.PieceSHA {
+		if ps.conn.Field.HasPiece(i) && !ps.t.havePiece(i) {
+			want = true
+			break
 		}
 	}
+	if want == ps.amInterested {
+		return
+	}
+	ps.amInterested = want
+	if want {
+		ps.conn.Send(&PeerMsg{MsgInterested, nil})
+	} else {
+		ps.conn.Send(&PeerMsg{MsgNotInterested, nil})
+	}
+}
 
-	return &pieceResult{state.index, state.data}, nil
+// 有请求在路上时对方应该很快回复，否则由读循环检查Idle超时
+func (ps *peerState) requestTimeout(d time.Duration) *time.Timer {
+	if ps.piece == nil || len(ps.piece.inflight) == 0 {
+		return nil
+	}
+	return time.NewTimer(d)
+}
+
+// 下一个要请求的block，优先重新请求之前被拒绝的，跳过之前的peer已经提供了的block
+func (state *taskState) nextBlock(task *pieceTask) (block, bool) {
+	if n := len(state.retry); n > 0 {
+		b := state.retry[n-1]
+		state.retry = state.retry[:n-1]
+		return b, true
+	}
+	for state.requested < task.length {
+		length := BLOCKSIZE
+		// 对一个piece中的最后一段，可能长度会短一些，做一下特殊处理
+		if task.length-state.requested < length {
+			length = task.length - state.requested
+		}
+		b := block{state.requested, length}
+		state.requested += length
+		if _, ok := task.blocks[b.offset]; !ok {
+			return b, true
+		}
+	}
+	return block{}, false
 }
 
 func checkPiece(task *pieceTask, res *pieceResult) bool {
 	sha := sha1.Sum(res.data)
-	if !bytes.Equal(task.sha[:], sha[:]) {
-		fmt.Printf("check integrity failed, index: %v\n", res.index)
+	return bytes.Equal(task.sha[:], sha[:])
+}
+
+// 初始化下载过程中的状态，Download和读取数据的一方谁先调用都可以
+func (t *TorrentTask) init() {
+	t.once.Do(func() {
+		t.queue = newPieceQueue()
+		t.pool = newPeerPool()
+		if t.bans == nil {
+			t.bans = newBanList()
+		}
+		t.incoming = make(chan *PeerConn)
+		t.done = make([]chan struct{}, len(t.PieceSHA))
+		for i := range t.done {
+			t.done[i] = make(chan struct{})
+		}
+	})
+}
+
+// 我们已经有的piece，以及它们的数量
+func (t *TorrentTask) bitfield() (Bitfield, int) {
+	field := make(Bitfield, (len(t.PieceSHA)+7)/8)
+	count := 0
+	for i := range t.PieceSHA {
+		if t.havePiece(i) {
+			field.SetPiece(i)
+			count++
+		}
+	}
+	return field, count
+}
+
+// 当前piece是否已经校验通过并写入文件
+func (t *TorrentTask) havePiece(index int) bool {
+	t.init()
+	select {
+	case <-t.done[index]:
+		return true
+	default:
 		return false
 	}
-	return true
+}
+
+// 阻塞直到index对应的piece可读，等待期间将该piece移到下载队列的最前面
+func (t *TorrentTask) waitPiece(ctx context.Context, index int) error {
+	if t.havePiece(index) {
+		return nil
+	}
+	t.queue.prioritize(index, index+1)
+	select {
+	case <-t.done[index]:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// 记录新完成的piece，唤醒所有peer向对方发送Have
+func (t *TorrentTask) addHave(index int) {
+	t.haveMu.Lock()
+	defer t.haveMu.Unlock()
+	t.haves = append(t.haves, index)
+	if t.haveNotify != nil {
+		close(t.haveNotify)
+		t.haveNotify = nil
+	}
+}
+
+// 第n个之后完成的piece，以及有新的piece完成时会被关闭的channel
+func (t *TorrentTask) havesSince(n int) ([]int, <-chan struct{}) {
+	t.haveMu.Lock()
+	defer t.haveMu.Unlock()
+	if t.haveNotify == nil {
+		t.haveNotify = make(chan struct{})
+	}
+	return t.haves[n:], t.haveNotify
+}
+
+// 将[begin, end)范围内的piece移到下载队列的最前面
+func (t *TorrentTask) prioritize(begin, end int) {
+	t.init()
+	t.queue.prioritize(begin, end)
 }
 
 // 这里的PeerInfo是准备建立连接的peer，要从该peer处下载
-func (t *TorrentTask) peerRoutine(peer PeerInfo, taskQueue chan *pieceTask, resultQueue chan *pieceResult) {
+// ctx取消或者所有piece都下载完成时返回，返回值为该peer退出的原因
+func (t *TorrentTask) peerRoutine(ctx context.Context, peer PeerInfo, resultQueue chan *pieceResult) error {
+	// 在Session中运行时，所有任务共享一个连接数的上限
+	err := t.acquireConn(ctx)
+	if err != nil {
+		return err
+	}
+	defer t.releaseConn()
+
+	if t.bans.isBanned(peer.Ip.String()) {
+		return ErrPeerBanned
+	}
+
 	// set up conn with peer
-	conn, err := NewConn(peer, t.InfoSHA, t.PeerId)
+	conn, err := dialConn(ctx, peer, t.InfoSHA, t.PeerId, dialOptions{encryption: t.Encryption, utp: t.utp, timeouts: t.Timeouts})
 	if err != nil {
-		fmt.Println("fail to connect peer: " + peer.Ip.String())
-		return
+		return err
 	}
-	defer conn.Close()
+	return t.servePeer(ctx, conn, resultQueue)
+}
 
-	fmt.Println("complete handshake with peer: " + peer.Ip.String())
-	// 开始给对方发请求，表示想要从那里下载
-	// 当前请求数据没有payload，只有Msg
-	conn.WriteMsg(&PeerMsg{MsgInterested, nil})
-	// 拿出taskQueue中的每一个task，判断对方有没有，如果有则开始下载
-	// 这里是串行的，对单个peer来说只能一块一块的下
-	// 而且这里是从channel中拿数据，可以保证多个go routine不会出问题
-	for task := range taskQueue {
-		// 没有这一片，放回taskQueue，准备从其他peer处下载
-		if !conn.Field.HasPiece(task.index) {
-			taskQueue <- task
-			continue
+// 从已经完成握手的conn处下载，主动建立的连接和对方发起的连接都由这里处理
+// 读写由conn的读写循环完成，这里等待消息、队列变化和超时，交给peerState处理
+func (t *TorrentTask) servePeer(ctx context.Context, conn *PeerConn, resultQueue chan *pieceResult) (err error) {
+	peer := conn.peer
+	defer conn.Close()
+	// 同一个peer可能有多个地址，或者同时由双方发起了连接
+	if !t.pool.register(conn.remoteId) {
+		return ErrDuplicatePeer
+	}
+	defer t.pool.unregister(conn.remoteId)
+	conn.ctx = ctx
+	conn.down = []*Limiter{DownloadLimit, t.down, t.DownloadLimit}
+	conn.up = []*Limiter{UploadLimit, t.up, t.UploadLimit}
+	t.connected.Add(1)
+	t.emit(Event{Type: EventPeerConnected, Peer: peer, Client: conn.Client()})
+	defer func() {
+		t.emit(Event{Type: EventPeerDisconnected, Peer: peer, Err: err})
+	}()
+
+	// 知道piece数量之后检查对方的bitfield，HaveAll表示所有piece都有，没有bitfield表示一个都没有
+	size := (len(t.PieceSHA) + 7) / 8
+	switch {
+	case conn.haveAll:
+		conn.Field = make(Bitfield, size)
+		for i := range t.PieceSHA {
+			conn.Field.SetPiece(i)
 		}
-		fmt.Printf("get task, index: %v, peer: %v\n", task.index, peer.Ip.String())
-
-		res, err := downloadPiece(conn, task)
+	case conn.Field == nil:
+		conn.Field = make(Bitfield, size)
+	default:
+		err = checkBitfield(conn.Field, len(t.PieceSHA))
 		if err != nil {
-			// 出现错误，放回taskQueue，从其他peer处再下载
-			taskQueue <- task
-			fmt.Println("fail to download piece " + err.Error())
-			return
+			return err
 		}
+	}
+	if conn.allowedFast == nil {
+		conn.allowedFast = make(map[int]bool)
+	}
+	if conn.rejected == nil {
+		conn.rejected = make(map[int]bool)
+	}
 
-		if !checkPiece(task, res) {
-			// 下下来校验不对，放回taskQueue，从其他peer处再下载
-			// 总之出现任何问题都放回taskQueue
-			taskQueue <- task
-			continue
+	conn.start()
+	ps := &peerState{t: t, ctx: ctx, conn: conn, results: resultQueue, amChoking: true}
+	// 先记下已经完成的数量再生成bitfield，中间完成的piece最多重复发送一次Have
+	haves, _ := t.havesSince(0)
+	ps.haveSent = len(haves)
+	// 握手之后的第一条消息告诉对方我们有哪些piece，支持fast extension时必须发送
+	field, count := t.bitfield()
+	switch {
+	case count > 0:
+		conn.Send(&PeerMsg{MsgBitfield, field})
+	case conn.fast:
+		conn.Send(&PeerMsg{MsgHaveNone, nil})
+	}
+	// 对方有我们需要的piece时告诉对方，表示想要从那里下载
+	ps.updateInterest()
+
+	// 退出时正在下载的piece放回队列
+	defer func() {
+		if ps.task != nil {
+			ps.abort(err)
+		}
+	}()
+	timeouts := conn.timeouts.withDefaults()
+	for {
+		// 对方或者使用同一个IP的其他peer发送了错误的数据
+		banWait, banned := t.bans.check(peer.Ip.String())
+		if banned {
+			return ErrPeerBanned
+		}
+		// 队列关闭表示所有piece都已下载完成或者下载被取消
+		wait, done := ps.fill()
+		if done {
+			return ctx.Err()
+		}
+		haveWait := ps.announce()
+		var timeout <-chan time.Time
+		timer := ps.requestTimeout(timeouts.Request)
+		if timer != nil {
+			timeout = timer.C
 		}
 
-		// 下载成功，放入result，等待后续组装
-		resultQueue <- res
+		select {
+		case msg, ok := <-conn.Incoming():
+			if !ok {
+				// 读写循环出错退出，取消时连接被关闭导致的错误返回ctx的错误
+				err = conn.Err()
+				if ctx.Err() != nil {
+					err = ctx.Err()
+				}
+				break
+			}
+			err = ps.handle(msg)
+		case <-wait:
+		case <-haveWait:
+		case <-banWait:
+		case <-timeout:
+			err = ErrRequestTimeout
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if err != nil {
+			return err
+		}
 	}
 }
 
@@ -205,58 +699,216 @@ func (t *TorrentTask) getPieceBounds(index int) (begin, end int) {
 	return
 }
 
-func Download(task *TorrentTask) error {
-	fmt.Println("start downloading " + task.FileName)
+// 下载整个任务，ctx取消、没有可用的peer或者写文件失败时返回相应的错误
+// 返回前会关闭所有peer的连接并等待其go routine退出
+// 可以在取消之后再次调用，已经校验通过的piece不会重复下载
+func Download(ctx context.Context, task *TorrentTask) error {
+	task.init()
+
+	// 先创建文件，每个piece校验通过后直接写入对应位置，这样下载过程中就可以读取已完成的部分
+	// 这里不能截断已有的文件，否则再次调用时之前下载的数据就丢了
+	file, err := os.OpenFile(task.FileName, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrStorage, err)
+	}
+	defer file.Close()
+	task.file = file
+
+	err = file.Truncate(int64(task.FileLen))
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrStorage, err)
+	}
 
-	// 划分piece任务并初始化task，result channel
+	// 只统计这一次下载中成功连接的peer，之前失败过的peer重新尝试
+	task.connected.Store(0)
+	task.pool.reset()
+	task.pool.add(task.PeerList...)
+	maxPeers := task.MaxPeers
+	if maxPeers <= 0 {
+		maxPeers = DefaultMaxPeers
+	}
+	retry := task.Retry.withDefaults()
+
+	// 返回时取消所有peer，关闭队列唤醒等待task的peer，并等待它们全部退出
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	defer func() {
+		cancel()
+		task.queue.close()
+		wg.Wait()
+	}()
+
+	// 划分piece任务并初始化task队列和result channel
 	// task数量与SHA的数量相同，每个task的piece都有其对应的SHA
-	// 指定channel的长度，如果channel已满，则新的go routine必须等待通道中的元素被取出后才能往其中加入新的元素
-	taskQueue := make(chan *pieceTask, len(task.PieceSHA))
 	resultQueue := make(chan *pieceResult)
+	peerExit := make(chan peerExitMsg)
 
-	// 创建所有Task
+	// 创建所有Task，跳过之前已经完成的piece
+	task.queue.reset()
+	count := 0
 	for index, sha := range task.PieceSHA {
+		if task.havePiece(index) {
+			count++
+			continue
+		}
 		begin, end := task.getPieceBounds(index)
-		taskQueue <- &pieceTask{index, sha, (end - begin)}
+		task.queue.push(&pieceTask{index: index, sha: sha, length: end - begin})
 	}
 
-	// 对每一个peer都起一个TorrentTask，下载整个任务中需要的部分
-	for _, peer := range task.PeerList {
-		go task.peerRoutine(peer, taskQueue, resultQueue)
+	// 对每一个peer都起一个go routine，下载整个任务中需要的部分，对方发起的连接pp为nil
+	// 退出时ctx可能已经取消，Download不再接收peerExit，因此发送时也要监听ctx
+	alive := 0
+	startPeer := func(pp *poolPeer, run func() error) {
+		alive++
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := run()
+			select {
+			case peerExit <- peerExitMsg{pp, err}:
+			case <-ctx.Done():
+			}
+		}()
+	}
+	// 从peer池中补充连接直到上限，返回还在等待重试的peer中最早可以连接的时间
+	banned := func(peer PeerInfo) bool {
+		return task.bans.isBanned(peer.Ip.String())
+	}
+	dialPeers := func() time.Time {
+		for alive < maxPeers {
+			pp, wake := task.pool.next(time.Now(), retry, banned)
+			if pp == nil {
+				return wake
+			}
+			startPeer(pp, func() error { return task.peerRoutine(ctx, pp.info, resultQueue) })
+		}
+		return time.Time{}
 	}
 
 	// 起完上面的go routine，代码继续向下执行，进入for中
-	// for中count一旦超过上限会结束，循环中从resultQueue中取出数据放入result的特定位置上
+	// for中count一旦超过上限会结束，循环中从resultQueue中取出数据写入文件的特定位置上
 
 	// 收集结果
-	buf := make([]byte, task.FileLen)
-	count := 0
+	var lastErr error // 最后一个退出的peer的原因，没有peer可用时一起返回
+	// 接收对方发起的连接时，所有peer都退出并且没有等待重试的peer之后再等待grace，这期间没有新的连接才返回
+	var grace <-chan time.Time
 	// 这个for实际上是while的用法
 	for count < len(task.PieceSHA) {
-		res := <-resultQueue
-		begin, end := task.getPieceBounds(res.index)
-		copy(buf[begin:end], res.data)
-		count++
+		wake := dialPeers()
+		switch {
+		case alive > 0 || !wake.IsZero():
+			grace = nil
+		case grace != nil:
+		case task.grace > 0:
+			grace = time.After(task.grace)
+		default:
+			// 所有peer都退出了，resultQueue不会再有新的结果，不能继续等下去
+			return task.noPeersErr(lastErr)
+		}
+		var retryTimer *time.Timer
+		var retryC <-chan time.Time
+		if !wake.IsZero() && alive < maxPeers {
+			retryTimer = time.NewTimer(time.Until(wake))
+			retryC = retryTimer.C
+		}
 
-		// 打印任务进度
-		percent := float64(count) / float64(len(task.PieceSHA)) * 100
-		fmt.Printf("downloading, progress: (%0.2f%%)\n", percent)
+		select {
+		case res := <-resultQueue:
+			begin, _ := task.getPieceBounds(res.index)
+			err = task.writeAt(file, res.data, int64(begin))
+			if err != nil {
+				return fmt.Errorf("%w: %w", ErrStorage, err)
+			}
+			close(task.done[res.index])
+			task.addHave(res.index)
+			count++
+			task.emit(Event{Type: EventPieceVerified, Index: res.index, Done: count, Total: len(task.PieceSHA)})
+		case conn := <-task.incoming:
+			// 对方主动发起的连接，Session已经完成了握手并占用了连接数
+			if alive >= maxPeers {
+				conn.Close()
+				task.releaseConn()
+				break
+			}
+			startPeer(nil, func() error {
+				defer task.releaseConn()
+				return task.servePeer(ctx, conn, resultQueue)
+			})
+		case e := <-peerExit:
+			// 断开的peer空出来的位置在下一次循环中由其他peer补上，出错的peer等待一段时间后重试
+			alive--
+			lastErr = e.err
+			if e.peer != nil {
+				task.pool.release(e.peer, e.err, retry)
+			}
+		case <-task.pool.wait():
+			// 有新的peer加入
+		case <-retryC:
+		case <-grace:
+			return task.noPeersErr(lastErr)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if retryTimer != nil {
+			retryTimer.Stop()
+		}
 	}
-	close(taskQueue)
-	close(resultQueue)
 
-	// 创建文件并复制buf中的数据
-	file, err := os.Create(task.FileName)
-	if err != nil {
-		fmt.Println("fail to create file: " + task.FileName)
+	task.emit(Event{Type: EventComplete, Done: count, Total: len(task.PieceSHA)})
+	return nil
+}
+
+// 没有peer可用时的错误，一个peer都没连上时为ErrAllPeersFailed，cause为最后一个peer退出的原因
+func (t *TorrentTask) noPeersErr(cause error) error {
+	err := ErrNoPeers
+	if t.connected.Load() == 0 && cause != nil {
+		err = ErrAllPeersFailed
+	}
+	if cause == nil {
 		return err
 	}
+	return fmt.Errorf("%w: %w", err, cause)
+}
 
-	_, err = file.Write(buf)
-	if err != nil {
-		fmt.Println("fail to write data")
-		return err
+// 占用一个连接数，达到上限时阻塞
+func (t *TorrentTask) acquireConn(ctx context.Context) error {
+	if t.conns == nil {
+		return nil
 	}
+	select {
+	case t.conns <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
 
-	return nil
+func (t *TorrentTask) releaseConn() {
+	if t.conns != nil {
+		<-t.conns
+	}
+}
+
+// 在Session中运行时通过共享的disk pool写文件，否则直接写
+func (t *TorrentTask) writeAt(file *os.File, data []byte, off int64) error {
+	if t.disk != nil {
+		return t.disk.do(func() error {
+			_, err := file.WriteAt(data, off)
+			return err
+		})
+	}
+	_, err := file.WriteAt(data, off)
+	return err
+}
+
+// 读取已经写入文件的数据，用于回复对方的请求
+func (t *TorrentTask) readAt(buf []byte, off int64) error {
+	if t.disk != nil {
+		return t.disk.do(func() error {
+			_, err := t.file.ReadAt(buf, off)
+			return err
+		})
+	}
+	_, err := t.file.ReadAt(buf, off)
+	return err
 }
@@ -0,0 +1,322 @@
+package torrent
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestTask(t *testing.T, peers []PeerInfo) *TorrentTask {
+	data := []byte("0123456789")
+	return &TorrentTask{
+		PeerList: peers,
+		FileName: filepath.Join(t.TempDir(), "file.bin"),
+		FileLen:  len(data),
+		PieceLen: len(data),
+		PieceSHA: [][SHALEN]byte{sha1.Sum(data)},
+	}
+}
+
+// 模拟一个peer，完成握手之后交给handle处理，测试结束时关闭连接
+func listenPeer(t *testing.T, handle func(c *PeerConn)) PeerInfo {
+	return listenPeerOn(t, "127.0.0.1", handle)
+}
+
+// 和listenPeer相同，但是监听在指定的IP上，用来模拟来自不同IP的peer
+func listenPeerOn(t *testing.T, ip string, handle func(c *PeerConn)) PeerInfo {
+	ln, err := net.Listen("tcp", ip+":0")
+	assert.Equal(t, nil, err)
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			hs, err := ReadHandshake(conn)
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			// 每个连接使用不同的peer id，否则会被当作重复的peer
+			id, _ := NewPeerID("-TS0001-")
+			WriteHandShake(conn, NewHandShakeMsg(hs.InfoSHA, id))
+			t.Cleanup(func() { conn.Close() })
+			go handle(&PeerConn{Conn: conn})
+		}
+	}()
+	addr := ln.Addr().(*net.TCPAddr)
+	return PeerInfo{Ip: addr.IP, Port: uint16(addr.Port)}
+}
+
+// 模拟一个完成握手并发送bitfield之后就不再响应的peer
+func stallPeer(t *testing.T) PeerInfo {
+	return listenPeer(t, func(c *PeerConn) {
+		c.WriteMsg(&PeerMsg{MsgBitfield, []byte{0x80}})
+	})
+}
+
+// 回复request，返回data中对应的数据
+func replyPiece(c *PeerConn, msg *PeerMsg, data []byte) {
+	begin := int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+	length := int(binary.BigEndian.Uint32(msg.Payload[8:12]))
+	payload := make([]byte, 8+length)
+	copy(payload, msg.Payload[:8])
+	copy(payload[8:], data[begin:])
+	c.WriteMsg(&PeerMsg{MsgPiece, payload})
+}
+
+func TestDownloadNoPeers(t *testing.T) {
+	task := newTestTask(t, nil)
+	err := Download(context.Background(), task)
+	assert.ErrorIs(t, err, ErrNoPeers)
+}
+
+func TestDownloadAllPeersFailed(t *testing.T) {
+	// 监听后立即关闭，得到一个连接会被拒绝的端口
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := ln.Addr().(*net.TCPAddr)
+	ln.Close()
+
+	task := newTestTask(t, []PeerInfo{{Ip: addr.IP, Port: uint16(addr.Port)}})
+	task.Retry = RetryPolicy{Attempts: 1}
+	err := Download(context.Background(), task)
+	assert.ErrorIs(t, err, ErrAllPeersFailed)
+	// 错误中带有peer失败的具体原因
+	assert.Contains(t, err.Error(), "connection refused")
+
+	// 之前成功连接过的peer不影响下一次下载的结果
+	task.connected.Store(1)
+	err = Download(context.Background(), task)
+	assert.ErrorIs(t, err, ErrAllPeersFailed)
+}
+
+func TestDownloadStorageError(t *testing.T) {
+	task := newTestTask(t, nil)
+	task.FileName = filepath.Join(t.TempDir(), "missing", "file.bin")
+	err := Download(context.Background(), task)
+	assert.ErrorIs(t, err, ErrStorage)
+	_, err = os.Stat(task.FileName)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestDownloadCancel(t *testing.T) {
+	task := newTestTask(t, []PeerInfo{stallPeer(t)})
+	var mu sync.Mutex
+	var events []EventType
+	task.Observer = ObserverFunc(func(e Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, e.Type)
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+
+	start := time.Now()
+	err := Download(ctx, task)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Less(t, time.Since(start), 2*time.Second)
+	assert.Equal(t, []EventType{EventPeerConnected, EventPeerDisconnected}, events)
+}
+
+func TestDownloadAllowedFast(t *testing.T) {
+	data := []byte("0123456789")
+	// 一直choke，但是piece 0是allowed fast的
+	peer := listenPeer(t, func(c *PeerConn) {
+		c.WriteMsg(&PeerMsg{MsgHaveAll, nil})
+		c.WriteMsg(&PeerMsg{MsgAllowedFast, []byte{0, 0, 0, 0}})
+		for {
+			msg, err := c.ReadMsg()
+			if err != nil {
+				return
+			}
+			if msg != nil && msg.Id == MsgRequest {
+				replyPiece(c, msg, data)
+			}
+		}
+	})
+	task := newTestTask(t, []PeerInfo{peer})
+	assert.Equal(t, nil, Download(context.Background(), task))
+	got, _ := os.ReadFile(task.FileName)
+	assert.Equal(t, data, got)
+}
+
+func TestDownloadRejectRetry(t *testing.T) {
+	data := []byte("0123456789")
+	// choke时拒绝第一个请求，unchoke之后正常回复
+	peer := listenPeer(t, func(c *PeerConn) {
+		c.WriteMsg(&PeerMsg{MsgHaveAll, nil})
+		c.WriteMsg(&PeerMsg{MsgAllowedFast, []byte{0, 0, 0, 0}})
+		rejected := false
+		for {
+			msg, err := c.ReadMsg()
+			if err != nil {
+				return
+			}
+			if msg == nil || msg.Id != MsgRequest {
+				continue
+			}
+			if !rejected {
+				rejected = true
+				c.WriteMsg(&PeerMsg{MsgReject, msg.Payload})
+				c.WriteMsg(&PeerMsg{MsgUnchoke, nil})
+				continue
+			}
+			replyPiece(c, msg, data)
+		}
+	})
+	task := newTestTask(t, []PeerInfo{peer})
+	assert.Equal(t, nil, Download(context.Background(), task))
+	got, _ := os.ReadFile(task.FileName)
+	assert.Equal(t, data, got)
+}
+
+func TestDownloadTimeouts(t *testing.T) {
+	// 一直choke并且不发送任何消息
+	task := newTestTask(t, []PeerInfo{stallPeer(t)})
+	task.Timeouts = Timeouts{Idle: 200 * time.Millisecond}
+	task.Retry = RetryPolicy{Attempts: 1}
+	err := Download(context.Background(), task)
+	assert.ErrorIs(t, err, ErrNoPeers)
+	assert.ErrorIs(t, err, ErrPeerIdle)
+
+	// unchoke之后不回复请求
+	peer := listenPeer(t, func(c *PeerConn) {
+		c.WriteMsg(&PeerMsg{MsgBitfield, []byte{0x80}})
+		c.WriteMsg(&PeerMsg{MsgUnchoke, nil})
+	})
+	task = newTestTask(t, []PeerInfo{peer})
+	task.Timeouts = Timeouts{Request: 200 * time.Millisecond}
+	task.Retry = RetryPolicy{Attempts: 1}
+	err = Download(context.Background(), task)
+	assert.ErrorIs(t, err, ErrRequestTimeout)
+}
+
+func TestServePeerUpload(t *testing.T) {
+	data := []byte("0123456789")
+	task := newTestTask(t, nil)
+	task.init()
+	assert.Equal(t, nil, os.WriteFile(task.FileName, data, 0644))
+	file, err := os.Open(task.FileName)
+	assert.Equal(t, nil, err)
+	defer file.Close()
+	task.file = file
+	close(task.done[0])
+
+	a, b := net.Pipe()
+	defer b.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	exit := make(chan error)
+	go func() {
+		exit <- task.servePeer(ctx, &PeerConn{Conn: a, Chocked: true, fast: true}, nil)
+	}()
+
+	r := &PeerConn{Conn: b}
+	next := func() *PeerMsg {
+		b.SetReadDeadline(time.Now().Add(time.Second))
+		msg, err := r.ReadMsg()
+		assert.Equal(t, nil, err)
+		return msg
+	}
+	// 已经有了所有piece，不会interested
+	assert.Equal(t, &PeerMsg{MsgBitfield, []byte{0x80}}, next())
+
+	// choke时拒绝请求，interested之后unchoke并回复数据
+	r.WriteMsg(NewRequestMsg(0, 2, 4))
+	assert.Equal(t, &PeerMsg{MsgReject, NewRequestMsg(0, 2, 4).Payload}, next())
+	r.WriteMsg(&PeerMsg{MsgInterested, nil})
+	assert.Equal(t, &PeerMsg{MsgUnchoke, []byte{}}, next())
+	r.WriteMsg(NewRequestMsg(0, 2, 4))
+	assert.Equal(t, &PeerMsg{MsgPiece, []byte{0, 0, 0, 0, 0, 0, 0, 2, '2', '3', '4', '5'}}, next())
+
+	// 超出piece范围的请求断开连接
+	r.WriteMsg(NewRequestMsg(0, 8, 4))
+	var perr *ProtocolError
+	assert.ErrorAs(t, <-exit, &perr)
+	cancel()
+}
+
+func TestServePeerInterest(t *testing.T) {
+	data := []byte("0123456789")
+	task := newTestTask(t, nil)
+	task.PieceLen = 5
+	task.PieceSHA = [][SHALEN]byte{sha1.Sum(data[:5]), sha1.Sum(data[5:])}
+	task.init()
+	close(task.done[0])
+
+	a, b := net.Pipe()
+	defer b.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go task.servePeer(ctx, &PeerConn{Conn: a, Chocked: true, fast: true}, nil)
+
+	r := &PeerConn{Conn: b}
+	next := func() *PeerMsg {
+		b.SetReadDeadline(time.Now().Add(time.Second))
+		msg, err := r.ReadMsg()
+		assert.Equal(t, nil, err)
+		return msg
+	}
+	// 对方什么都没有，不interested
+	assert.Equal(t, &PeerMsg{MsgBitfield, []byte{0x80}}, next())
+	// 对方有我们已经有的piece，仍然不interested，有我们没有的piece时interested
+	r.WriteMsg(NewHaveMsg(0))
+	r.WriteMsg(NewHaveMsg(1))
+	assert.Equal(t, &PeerMsg{MsgInterested, []byte{}}, next())
+
+	// 完成之后对方已经有这个piece，不发送Have，只是不再interested
+	close(task.done[1])
+	task.addHave(1)
+	assert.Equal(t, &PeerMsg{MsgNotInterested, []byte{}}, next())
+}
+
+func TestDownloadHave(t *testing.T) {
+	data := []byte("0123456789")
+	// 一个peer只有piece 0，另一个只有piece 1
+	// 只有piece 1的peer收到piece 0的Have之后才开始上传，只有piece 0的peer不应该收到它的Have
+	var gotHave0 atomic.Bool
+	seeder := func(field byte, index int, waitHave bool) PeerInfo {
+		return listenPeer(t, func(c *PeerConn) {
+			c.WriteMsg(&PeerMsg{MsgBitfield, []byte{field}})
+			if !waitHave {
+				c.WriteMsg(&PeerMsg{MsgUnchoke, nil})
+			}
+			for {
+				msg, err := c.ReadMsg()
+				if err != nil {
+					return
+				}
+				switch {
+				case msg == nil:
+				case msg.Id == MsgHave && binary.BigEndian.Uint32(msg.Payload) == 0:
+					if waitHave {
+						c.WriteMsg(&PeerMsg{MsgUnchoke, nil})
+					} else {
+						gotHave0.Store(true)
+					}
+				case msg.Id == MsgRequest:
+					replyPiece(c, msg, data[index*5:index*5+5])
+				}
+			}
+		})
+	}
+	task := newTestTask(t, []PeerInfo{seeder(0x80, 0, false), seeder(0x40, 1, true)})
+	task.PieceLen = 5
+	task.PieceSHA = [][SHALEN]byte{sha1.Sum(data[:5]), sha1.Sum(data[5:])}
+	assert.Equal(t, nil, Download(context.Background(), task))
+	got, _ := os.ReadFile(task.FileName)
+	assert.Equal(t, data, got)
+	assert.False(t, gotHave0.Load())
+}
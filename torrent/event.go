@@ -0,0 +1,71 @@
+package torrent
+
+import "errors"
+
+var ErrPieceHash = errors.New("piece hash mismatch")
+
+type EventType uint8
+
+const (
+	EventPieceVerified    EventType = iota // piece校验通过并写入文件，Done/Total为当前进度
+	EventPieceFailed                       // piece下载失败或者校验失败，Err为失败原因
+	EventPeerConnected                     // 与peer完成握手
+	EventPeerDisconnected                  // peer的连接断开，Err为断开原因
+	EventAnnounce                          // 向tracker请求peer的结果，Peers为得到的peer数量
+	EventBytes                             // 从peer处收到了Bytes个byte的数据
+	EventComplete                          // 所有piece都下载完成
+	EventPeerBanned                        // peer的IP因为发送错误的数据被ban，Peer中只有Ip
+)
+
+func (e EventType) String() string {
+	switch e {
+	case EventPieceVerified:
+		return "piece verified"
+	case EventPieceFailed:
+		return "piece failed"
+	case EventPeerConnected:
+		return "peer connected"
+	case EventPeerDisconnected:
+		return "peer disconnected"
+	case EventAnnounce:
+		return "announce"
+	case EventBytes:
+		return "bytes"
+	case EventComplete:
+		return "complete"
+	case EventPeerBanned:
+		return "peer banned"
+	}
+	return "unknown"
+}
+
+// 下载过程中发生的事件，不同类型的事件只会设置其中的一部分字段
+type Event struct {
+	Type   EventType
+	Index  int // piece的index
+	Peer   PeerInfo
+	Client ClientInfo // 对方的客户端，只在EventPeerConnected中设置
+	Bytes  int
+	Done   int // 已经完成的piece数量
+	Total  int // piece的总数
+	Peers  int
+	Err    error
+}
+
+// 事件的接收者，会在多个go routine中被调用，实现时需要自己处理并发，并且不能阻塞太久
+type Observer interface {
+	OnEvent(e Event)
+}
+
+// 让普通函数也可以作为Observer使用
+type ObserverFunc func(e Event)
+
+func (f ObserverFunc) OnEvent(e Event) {
+	f(e)
+}
+
+func (t *TorrentTask) emit(e Event) {
+	if t.Observer != nil {
+		t.Observer.OnEvent(e)
+	}
+}
@@ -1,7 +1,6 @@
 package torrent
 
 import (
-	"fmt"
 	"io"
 )
 
@@ -10,18 +9,32 @@ const (
 	HsMsgLen int = SHALEN + IDLEN + Reserved // 包括InfoSHA的长度和PeerId的长度，用于标识文件信息和下载器信息
 )
 
+const protocolName = "BitTorrent protocol"
+
+// 保留位中表示支持fast extension(BEP 6)的位，在最后一个byte中
+const fastExtBit byte = 0x04
+
 type HandshakeMsg struct {
-	PreStr  string
-	InfoSHA [SHALEN]byte
-	PeerId  [IDLEN]byte
+	PreStr   string
+	Reserved [Reserved]byte
+	InfoSHA  [SHALEN]byte
+	PeerId   [IDLEN]byte
 }
 
+// 默认声明支持fast extension
 func NewHandShakeMsg(infoSHA [SHALEN]byte, peerId [IDLEN]byte) *HandshakeMsg {
-	return &HandshakeMsg{
-		PreStr:  "BitTorrent protocol",
+	msg := &HandshakeMsg{
+		PreStr:  protocolName,
 		InfoSHA: infoSHA,
 		PeerId:  peerId,
 	}
+	msg.Reserved[7] |= fastExtBit
+	return msg
+}
+
+// 对方是否支持fast extension
+func (msg *HandshakeMsg) SupportsFast() bool {
+	return msg.Reserved[7]&fastExtBit != 0
 }
 
 func WriteHandShake(w io.Writer, msg *HandshakeMsg) (int, error) {
@@ -31,7 +44,7 @@ func WriteHandShake(w io.Writer, msg *HandshakeMsg) (int, error) {
 	cur := 1
 	// 不断将信息加入buf slice的尾部
 	cur += copy(buf[cur:], []byte(msg.PreStr)) // 这里做了一个类型转换，将PreStr转为byte slice
-	cur += copy(buf[cur:], make([]byte, Reserved))
+	cur += copy(buf[cur:], msg.Reserved[:])
 	cur += copy(buf[cur:], msg.InfoSHA[:])
 	cur += copy(buf[cur:], msg.PeerId[:])
 
@@ -45,10 +58,10 @@ func ReadHandshake(r io.Reader) (*HandshakeMsg, error) {
 		return nil, err
 	}
 
+	// 目前只有BitTorrent protocol一种协议，长度不对时不再读取后面的内容
 	prelen := int(lenBuf[0])
-	if prelen == 0 {
-		err := fmt.Errorf("prelen cannot be 0")
-		return nil, err
+	if prelen != len(protocolName) {
+		return nil, protocolErr("handshake", "unexpected protocol name length %d", prelen)
 	}
 
 	msgBuf := make([]byte, HsMsgLen+prelen)
@@ -57,15 +70,22 @@ func ReadHandshake(r io.Reader) (*HandshakeMsg, error) {
 		return nil, err
 	}
 
+	if string(msgBuf[0:prelen]) != protocolName {
+		return nil, protocolErr("handshake", "unexpected protocol name %q", msgBuf[0:prelen])
+	}
+
 	var peerId [IDLEN]byte
 	var infoSHA [SHALEN]byte
+	var reserved [Reserved]byte
 
+	copy(reserved[:], msgBuf[prelen:prelen+Reserved])
 	copy(infoSHA[:], msgBuf[prelen+Reserved:prelen+Reserved+SHALEN])
 	copy(peerId[:], msgBuf[prelen+Reserved+SHALEN:])
 
 	return &HandshakeMsg{
-		PreStr:  string(msgBuf[0:prelen]),
-		InfoSHA: infoSHA,
-		PeerId:  peerId,
+		PreStr:   string(msgBuf[0:prelen]),
+		Reserved: reserved,
+		InfoSHA:  infoSHA,
+		PeerId:   peerId,
 	}, nil
 }
@@ -0,0 +1,48 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadHandshake(t *testing.T) {
+	var peerId [IDLEN]byte
+	msg := NewHandShakeMsg(sha1.Sum([]byte("handshake")), peerId)
+	var buf bytes.Buffer
+	WriteHandShake(&buf, msg)
+	raw := buf.Bytes()
+
+	res, err := ReadHandshake(bytes.NewReader(raw))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, msg, res)
+
+	// 其他协议的握手
+	var perr *ProtocolError
+	bad := append([]byte(nil), raw...)
+	bad[1] = 'b'
+	_, err = ReadHandshake(bytes.NewReader(bad))
+	assert.ErrorAs(t, err, &perr)
+	_, err = ReadHandshake(bytes.NewReader([]byte{0}))
+	assert.ErrorAs(t, err, &perr)
+}
+
+func FuzzReadHandshake(f *testing.F) {
+	var buf bytes.Buffer
+	WriteHandShake(&buf, NewHandShakeMsg(sha1.Sum([]byte("fuzz")), [IDLEN]byte{}))
+	f.Add(buf.Bytes())
+	f.Add([]byte{0})
+	f.Add([]byte{0xff, 'B'})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg, err := ReadHandshake(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		// 能解析的握手重新写出来和输入的开头相同
+		var out bytes.Buffer
+		WriteHandShake(&out, msg)
+		assert.True(t, bytes.HasPrefix(data, out.Bytes()))
+	})
+}
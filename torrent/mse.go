@@ -0,0 +1,382 @@
+package torrent
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+)
+
+// Message Stream Encryption(MSE/PE)，在BitTorrent握手之前用Diffie-Hellman交换密钥，
+// 之后的数据用RC4加密，让运营商无法根据明文握手识别和限速
+// 协议说明见 https://wiki.vuze.com/w/Message_Stream_Encryption
+
+// 连接的加密策略
+type EncryptionPolicy int
+
+const (
+	EncryptionDisable EncryptionPolicy = iota // 只使用明文握手
+	EncryptionPrefer                          // 优先使用RC4加密，对方不支持时使用明文
+	EncryptionRequire                         // 只接受RC4加密的连接
+)
+
+func (p EncryptionPolicy) String() string {
+	switch p {
+	case EncryptionDisable:
+		return "disable"
+	case EncryptionPrefer:
+		return "prefer"
+	case EncryptionRequire:
+		return "require"
+	}
+	return "unknown"
+}
+
+func ParseEncryptionPolicy(s string) (EncryptionPolicy, error) {
+	for _, p := range []EncryptionPolicy{EncryptionDisable, EncryptionPrefer, EncryptionRequire} {
+		if p.String() == s {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown encryption policy: %q", s)
+}
+
+var ErrEncryptionRequired = errors.New("encryption required")
+
+const (
+	mseKeyLen = 96  // DH公钥的长度
+	msePadMax = 512 // 随机填充的最大长度
+
+	// crypto_provide和crypto_select中的位
+	cryptoPlain uint32 = 0x01
+	cryptoRC4   uint32 = 0x02
+)
+
+var (
+	// 768位的素数，生成元为2
+	dhPrime, _  = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+	dhGenerator = big.NewInt(2)
+
+	mseVC [8]byte // verification constant，8个0
+)
+
+// 握手之后的连接，数据经过RC4加解密，选择明文时enc和dec为nil
+type mseConn struct {
+	net.Conn
+	r    *bufio.Reader // 握手时多读到的数据留在这里
+	head []byte        // 对方在握手中附带的初始数据(IA)，已经解密
+	dec  *rc4.Cipher
+	enc  *rc4.Cipher
+	mu   sync.Mutex // RC4是有状态的，写入必须串行
+}
+
+func (c *mseConn) Read(p []byte) (int, error) {
+	if len(c.head) > 0 {
+		n := copy(p, c.head)
+		c.head = c.head[n:]
+		return n, nil
+	}
+	n, err := c.r.Read(p)
+	if c.dec != nil {
+		c.dec.XORKeyStream(p[:n], p[:n])
+	}
+	return n, err
+}
+
+func (c *mseConn) Write(p []byte) (int, error) {
+	if c.enc == nil {
+		return c.Conn.Write(p)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	buf := make([]byte, len(p))
+	c.enc.XORKeyStream(buf, p)
+	return c.Conn.Write(buf)
+}
+
+// 生成DH的私钥和公钥，公钥补齐到96个byte
+func newDHKey() (*big.Int, []byte, error) {
+	x := make([]byte, 20)
+	_, err := rand.Read(x)
+	if err != nil {
+		return nil, nil, err
+	}
+	priv := new(big.Int).SetBytes(x)
+	pub := make([]byte, mseKeyLen)
+	new(big.Int).Exp(dhGenerator, priv, dhPrime).FillBytes(pub)
+	return priv, pub, nil
+}
+
+// 根据对方的公钥计算共享的密钥S
+func dhSecret(priv *big.Int, pub []byte) ([]byte, error) {
+	y := new(big.Int).SetBytes(pub)
+	if y.Cmp(big.NewInt(1)) <= 0 || y.Cmp(new(big.Int).Sub(dhPrime, big.NewInt(1))) >= 0 {
+		return nil, fmt.Errorf("invalid dh public key")
+	}
+	s := make([]byte, mseKeyLen)
+	new(big.Int).Exp(y, priv, dhPrime).FillBytes(s)
+	return s, nil
+}
+
+func mseHash(parts ...[]byte) []byte {
+	h := sha1.New()
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return h.Sum(nil)
+}
+
+func xorBytes(a, b []byte) []byte {
+	out := make([]byte, len(a))
+	for i := range a {
+		out[i] = a[i] ^ b[i]
+	}
+	return out
+}
+
+// RC4的密钥为SHA1(name, S, SKEY)，丢弃最开始的1024个byte
+func newMSECipher(name string, s, skey []byte) *rc4.Cipher {
+	c, _ := rc4.NewCipher(mseHash([]byte(name), s, skey))
+	var discard [1024]byte
+	c.XORKeyStream(discard[:], discard[:])
+	return c
+}
+
+// 0到512个byte的随机填充
+func msePad() ([]byte, error) {
+	var n [2]byte
+	_, err := rand.Read(n[:])
+	if err != nil {
+		return nil, err
+	}
+	pad := make([]byte, int(binary.BigEndian.Uint16(n[:]))%(msePadMax+1))
+	_, err = rand.Read(pad)
+	return pad, err
+}
+
+// 在r中跳过最多max个byte，直到读到mark为止
+func mseSync(r *bufio.Reader, mark []byte, max int) error {
+	window := make([]byte, 0, max+len(mark))
+	for len(window) < cap(window) {
+		b, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		window = append(window, b)
+		if bytes.HasSuffix(window, mark) {
+			return nil
+		}
+	}
+	return fmt.Errorf("mse sync marker not found")
+}
+
+// 解密读取n个byte
+func mseRead(r io.Reader, dec *rc4.Cipher, n int) ([]byte, error) {
+	buf := make([]byte, n)
+	_, err := io.ReadFull(r, buf)
+	if err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(buf, buf)
+	return buf, nil
+}
+
+// 作为发起方完成MSE握手，provide为可以接受的加密方式，infoSHA作为SKEY，超时由调用者设置
+func mseInitiate(conn net.Conn, infoSHA [SHALEN]byte, provide uint32) (net.Conn, error) {
+	// 1. A->B: Ya, PadA
+	priv, pub, err := newDHKey()
+	if err != nil {
+		return nil, err
+	}
+	pad, err := msePad()
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.Write(append(pub, pad...))
+	if err != nil {
+		return nil, err
+	}
+
+	// 2. B->A: Yb, PadB
+	r := bufio.NewReader(conn)
+	yb := make([]byte, mseKeyLen)
+	_, err = io.ReadFull(r, yb)
+	if err != nil {
+		return nil, err
+	}
+	s, err := dhSecret(priv, yb)
+	if err != nil {
+		return nil, err
+	}
+	skey := infoSHA[:]
+	enc := newMSECipher("keyA", s, skey)
+	dec := newMSECipher("keyB", s, skey)
+
+	// 3. A->B: HASH('req1', S), HASH('req2', SKEY) xor HASH('req3', S), ENCRYPT(VC, crypto_provide, len(PadC), PadC, len(IA))
+	// 不附带IA，BitTorrent握手在MSE完成之后正常发送
+	msg := mseHash([]byte("req1"), s)
+	msg = append(msg, xorBytes(mseHash([]byte("req2"), skey), mseHash([]byte("req3"), s))...)
+	plain := make([]byte, len(mseVC)+4+2+2)
+	binary.BigEndian.PutUint32(plain[8:12], provide)
+	enc.XORKeyStream(plain, plain)
+	_, err = conn.Write(append(msg, plain...))
+	if err != nil {
+		return nil, err
+	}
+
+	// 4. B->A: ENCRYPT(VC, crypto_select, len(padD), padD)
+	// 加密后的VC之前是长度未知的PadB，通过它找到加密数据的开始
+	mark := make([]byte, len(mseVC))
+	dec.XORKeyStream(mark, mseVC[:])
+	err = mseSync(r, mark, msePadMax)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := mseRead(r, dec, 4+2)
+	if err != nil {
+		return nil, err
+	}
+	sel := binary.BigEndian.Uint32(buf[0:4])
+	if sel&provide == 0 || (sel != cryptoPlain && sel != cryptoRC4) {
+		return nil, fmt.Errorf("invalid crypto_select: %d", sel)
+	}
+	padLen := int(binary.BigEndian.Uint16(buf[4:6]))
+	if padLen > msePadMax {
+		return nil, fmt.Errorf("padD too long: %d", padLen)
+	}
+	_, err = mseRead(r, dec, padLen)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &mseConn{Conn: conn, r: r}
+	if sel == cryptoRC4 {
+		c.enc, c.dec = enc, dec
+	}
+	return c, nil
+}
+
+// 处理对方发起的连接，根据前20个byte判断是明文握手还是MSE
+// infoHashes返回所有可以接受的SKEY，对方使用MSE时返回匹配的info hash，明文时返回nil
+func mseAccept(conn net.Conn, policy EncryptionPolicy, infoHashes func() [][SHALEN]byte) (net.Conn, *[SHALEN]byte, error) {
+	r := bufio.NewReader(conn)
+	prefix, err := r.Peek(1 + len(protocolName))
+	if err != nil {
+		return nil, nil, err
+	}
+	if prefix[0] == byte(len(protocolName)) && string(prefix[1:]) == protocolName {
+		if policy == EncryptionRequire {
+			return nil, nil, ErrEncryptionRequired
+		}
+		return &mseConn{Conn: conn, r: r}, nil, nil
+	}
+	if policy == EncryptionDisable {
+		return nil, nil, fmt.Errorf("unexpected handshake prefix: %x", prefix)
+	}
+
+	// 1. A->B: Ya, PadA
+	ya := make([]byte, mseKeyLen)
+	_, err = io.ReadFull(r, ya)
+	if err != nil {
+		return nil, nil, err
+	}
+	priv, pub, err := newDHKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	s, err := dhSecret(priv, ya)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// 2. B->A: Yb, PadB
+	pad, err := msePad()
+	if err != nil {
+		return nil, nil, err
+	}
+	_, err = conn.Write(append(pub, pad...))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// 3. A->B: HASH('req1', S)之前是长度未知的PadA
+	err = mseSync(r, mseHash([]byte("req1"), s), msePadMax)
+	if err != nil {
+		return nil, nil, err
+	}
+	obfs := make([]byte, sha1.Size)
+	_, err = io.ReadFull(r, obfs)
+	if err != nil {
+		return nil, nil, err
+	}
+	// 用HASH('req2', SKEY)找到对方要下载的种子
+	req3 := mseHash([]byte("req3"), s)
+	var skey *[SHALEN]byte
+	for _, h := range infoHashes() {
+		if bytes.Equal(xorBytes(mseHash([]byte("req2"), h[:]), req3), obfs) {
+			h := h
+			skey = &h
+			break
+		}
+	}
+	if skey == nil {
+		return nil, nil, fmt.Errorf("unknown mse skey")
+	}
+	dec := newMSECipher("keyA", s, skey[:])
+	enc := newMSECipher("keyB", s, skey[:])
+
+	buf, err := mseRead(r, dec, len(mseVC)+4+2)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !bytes.Equal(buf[:len(mseVC)], mseVC[:]) {
+		return nil, nil, fmt.Errorf("invalid mse verification constant")
+	}
+	provide := binary.BigEndian.Uint32(buf[8:12])
+	padLen := int(binary.BigEndian.Uint16(buf[12:14]))
+	if padLen > msePadMax {
+		return nil, nil, fmt.Errorf("padC too long: %d", padLen)
+	}
+	buf, err = mseRead(r, dec, padLen+2)
+	if err != nil {
+		return nil, nil, err
+	}
+	ia, err := mseRead(r, dec, int(binary.BigEndian.Uint16(buf[padLen:])))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// 对方提供RC4时总是选择RC4
+	var sel uint32
+	switch {
+	case provide&cryptoRC4 != 0:
+		sel = cryptoRC4
+	case provide&cryptoPlain != 0 && policy != EncryptionRequire:
+		sel = cryptoPlain
+	default:
+		return nil, nil, fmt.Errorf("%w: crypto_provide %d", ErrEncryptionRequired, provide)
+	}
+
+	// 4. B->A: ENCRYPT(VC, crypto_select, len(padD), padD)
+	reply := make([]byte, len(mseVC)+4+2)
+	binary.BigEndian.PutUint32(reply[8:12], sel)
+	enc.XORKeyStream(reply, reply)
+	_, err = conn.Write(reply)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c := &mseConn{Conn: conn, r: r, head: ia}
+	if sel == cryptoRC4 {
+		c.enc, c.dec = enc, dec
+	}
+	return c, skey, nil
+}
@@ -0,0 +1,107 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 通过net.Pipe完成一次MSE握手和BitTorrent握手，然后双向发送数据
+func mseExchange(t *testing.T, provide uint32, policy EncryptionPolicy) (*PeerConn, error) {
+	infoSHA := sha1.Sum([]byte("mse"))
+	var peerId [IDLEN]byte
+	a, b := net.Pipe()
+	t.Cleanup(func() { a.Close(); b.Close() })
+
+	go func() {
+		conn, err := mseInitiate(a, infoSHA, provide)
+		if err != nil {
+			a.Close()
+			return
+		}
+		_, err = handshake(conn, infoSHA, peerId)
+		if err != nil {
+			a.Close()
+			return
+		}
+		c := &PeerConn{Conn: conn}
+		c.WriteMsg(&PeerMsg{MsgBitfield, []byte{0x40}})
+		msg, err := c.ReadMsg()
+		if err == nil {
+			c.WriteMsg(msg)
+		}
+	}()
+
+	hashes := func() [][SHALEN]byte {
+		return [][SHALEN]byte{sha1.Sum([]byte("other")), infoSHA}
+	}
+	c, err := acceptConn(b, peerId, policy, Timeouts{}, hashes)
+	if err != nil {
+		return nil, err
+	}
+	assert.Equal(t, infoSHA, c.infoSHA)
+	assert.True(t, c.Field.HasPiece(1))
+	_, err = c.WriteMsg(&PeerMsg{MsgHave, []byte{0, 0, 0, 2}})
+	assert.Equal(t, nil, err)
+	msg, err := c.ReadMsg()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, &PeerMsg{MsgHave, []byte{0, 0, 0, 2}}, msg)
+	return c, nil
+}
+
+func TestMSEHandshake(t *testing.T) {
+	// 对方提供RC4时选择RC4
+	c, err := mseExchange(t, cryptoRC4|cryptoPlain, EncryptionPrefer)
+	assert.Equal(t, nil, err)
+	assert.NotNil(t, c.Conn.(*mseConn).enc)
+
+	// 只提供明文时，MSE只用于混淆握手
+	c, err = mseExchange(t, cryptoPlain, EncryptionPrefer)
+	assert.Equal(t, nil, err)
+	assert.Nil(t, c.Conn.(*mseConn).enc)
+
+	_, err = mseExchange(t, cryptoPlain, EncryptionRequire)
+	assert.ErrorIs(t, err, ErrEncryptionRequired)
+
+	_, err = mseExchange(t, cryptoRC4, EncryptionDisable)
+	assert.NotEqual(t, nil, err)
+}
+
+func TestMSEAcceptPlaintext(t *testing.T) {
+	infoSHA := sha1.Sum([]byte("mse"))
+	var peerId [IDLEN]byte
+	hashes := func() [][SHALEN]byte { return [][SHALEN]byte{infoSHA} }
+
+	for _, policy := range []EncryptionPolicy{EncryptionDisable, EncryptionPrefer, EncryptionRequire} {
+		a, b := net.Pipe()
+		go func() {
+			WriteHandShake(a, NewHandShakeMsg(infoSHA, peerId))
+			ReadHandshake(a)
+			a.Close()
+		}()
+		_, err := acceptConn(b, peerId, policy, Timeouts{}, hashes)
+		if policy == EncryptionRequire {
+			assert.ErrorIs(t, err, ErrEncryptionRequired)
+		} else {
+			// 握手之后对方关闭了连接，读取bitfield时返回EOF
+			assert.ErrorIs(t, err, io.EOF)
+		}
+		b.Close()
+	}
+}
+
+func TestMSEUnknownSKey(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	go func() {
+		mseInitiate(a, sha1.Sum([]byte("unknown")), cryptoRC4)
+		a.Close()
+	}()
+	_, err := acceptConn(b, [IDLEN]byte{}, EncryptionPrefer, Timeouts{}, func() [][SHALEN]byte {
+		return [][SHALEN]byte{sha1.Sum([]byte("mse"))}
+	})
+	assert.NotEqual(t, nil, err)
+}
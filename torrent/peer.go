@@ -2,11 +2,14 @@ package torrent
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"strconv"
+	"sync"
 	"time"
 )
 
@@ -22,8 +25,94 @@ const (
 	MsgRequest       MsgId = 6
 	MsgPiece         MsgId = 7
 	MsgCancel        MsgId = 8
+
+	// fast extension(BEP 6)，只有双方握手时都声明支持时才能使用
+	MsgSuggest     MsgId = 0x0D
+	MsgHaveAll     MsgId = 0x0E
+	MsgHaveNone    MsgId = 0x0F
+	MsgReject      MsgId = 0x10
+	MsgAllowedFast MsgId = 0x11
 )
 
+func (id MsgId) String() string {
+	switch id {
+	case MsgChoke:
+		return "choke"
+	case MsgUnchoke:
+		return "unchoke"
+	case MsgInterested:
+		return "interested"
+	case MsgNotInterested:
+		return "not interested"
+	case MsgHave:
+		return "have"
+	case MsgBitfield:
+		return "bitfield"
+	case MsgRequest:
+		return "request"
+	case MsgPiece:
+		return "piece"
+	case MsgCancel:
+		return "cancel"
+	case MsgSuggest:
+		return "suggest"
+	case MsgHaveAll:
+		return "have all"
+	case MsgHaveNone:
+		return "have none"
+	case MsgReject:
+		return "reject"
+	case MsgAllowedFast:
+		return "allowed fast"
+	}
+	return "msg " + strconv.Itoa(int(id))
+}
+
+// fast extension的消息，对方没有在握手中声明支持时不能发送
+func (id MsgId) fast() bool {
+	return id >= MsgSuggest && id <= MsgAllowedFast
+}
+
+const (
+	MaxMsgLen   = 1 << 20    // 消息的最大长度，超过时直接断开，不分配内存
+	MaxBlockLen = 128 * 1024 // piece消息中数据的最大长度
+)
+
+// 对方违反协议时返回的错误，收到之后断开连接
+type ProtocolError struct {
+	Msg    string // 出错的消息，例如handshake、bitfield
+	Reason string
+}
+
+func (e *ProtocolError) Error() string {
+	return "protocol error: " + e.Msg + ": " + e.Reason
+}
+
+func protocolErr(msg string, format string, args ...any) error {
+	return &ProtocolError{Msg: msg, Reason: fmt.Sprintf(format, args...)}
+}
+
+// 检查每种消息的payload长度，未知的消息只受MaxMsgLen限制
+func checkPayloadLen(id MsgId, n int) error {
+	want := -1
+	switch id {
+	case MsgChoke, MsgUnchoke, MsgInterested, MsgNotInterested, MsgHaveAll, MsgHaveNone:
+		want = 0
+	case MsgHave, MsgSuggest, MsgAllowedFast:
+		want = 4
+	case MsgRequest, MsgCancel, MsgReject:
+		want = 12
+	case MsgPiece:
+		if n < 8 || n > 8+MaxBlockLen {
+			return protocolErr(id.String(), "invalid payload length %d", n)
+		}
+	}
+	if want >= 0 && n != want {
+		return protocolErr(id.String(), "expected payload length %d, got %d", want, n)
+	}
+	return nil
+}
+
 type PeerMsg struct {
 	Id      MsgId
 	Payload []byte
@@ -35,113 +124,450 @@ type PeerConn struct {
 	Field    Bitfield
 	peer     PeerInfo
 	peerId   [IDLEN]byte
+	remoteId [IDLEN]byte // 对方在握手中发送的peer id
 	infoSHA  [SHALEN]byte
+
+	fast        bool         // 双方都支持fast extension
+	haveAll     bool         // 对方发送了HaveAll，知道piece数量之后再填充Field
+	allowedFast map[int]bool // 被choke时也可以请求的piece
+	rejected    map[int]bool // 被对方拒绝过的piece，不再向该peer请求
+	pending     *PeerMsg     // fillBitfield读到的不是bitfield的第一条消息，留给ReadMsg返回
+
+	// 只对piece消息中的数据限速，choke、have等协议消息不受影响
+	ctx  context.Context // 等待限速时使用，为nil时一直等待
+	down []*Limiter
+	up   []*Limiter
+
+	timeouts Timeouts
+
+	// start之后由读循环和写循环负责所有的读写，其他go routine只通过Send和Incoming收发消息
+	in        chan *PeerMsg // 读循环收到的消息，读循环退出时关闭
+	outMu     sync.Mutex
+	out       []*PeerMsg    // 等待写循环发送的消息
+	outReady  chan struct{} // out中有新的消息
+	closed    chan struct{}
+	closeOnce sync.Once
+	errMu     sync.Mutex
+	err       error // 读写循环退出的原因
 }
 
-// 与peer建立连接的过程
-func handshake(conn net.Conn, infoSHA [SHALEN]byte, peerId [IDLEN]byte) error {
-	conn.SetDeadline(time.Now().Add(3 * time.Second))
-	defer conn.SetDeadline(time.Time{})
+// 连接各个阶段的超时，为0的项使用DefaultTimeouts中的值
+type Timeouts struct {
+	Dial      time.Duration // 建立TCP连接
+	Handshake time.Duration // MSE和BitTorrent握手
+	Bitfield  time.Duration // 握手之后等待对方的bitfield，超时表示对方没有任何piece
+	Request   time.Duration // 有请求没有回应时，对方多久没有发送消息就断开
+	Idle      time.Duration // 没有请求时，对方多久没有发送消息就断开
+	KeepAlive time.Duration // 多久没有发送消息时发送keep alive
+}
 
+var DefaultTimeouts = Timeouts{
+	Dial:      5 * time.Second,
+	Handshake: 10 * time.Second,
+	Bitfield:  5 * time.Second,
+	Request:   15 * time.Second,
+	Idle:      3 * time.Minute,
+	KeepAlive: 2 * time.Minute,
+}
+
+var (
+	ErrPeerIdle       = errors.New("peer idle")
+	ErrRequestTimeout = errors.New("request timeout")
+)
+
+// 为0的项使用默认值
+func (t Timeouts) withDefaults() Timeouts {
+	d := DefaultTimeouts
+	for _, f := range []struct{ v, def *time.Duration }{
+		{&t.Dial, &d.Dial},
+		{&t.Handshake, &d.Handshake},
+		{&t.Bitfield, &d.Bitfield},
+		{&t.Request, &d.Request},
+		{&t.Idle, &d.Idle},
+		{&t.KeepAlive, &d.KeepAlive},
+	} {
+		if *f.v <= 0 {
+			*f.v = *f.def
+		}
+	}
+	return t
+}
+
+// 与peer建立连接的过程
+// 超时由调用者设置
+func handshake(conn net.Conn, infoSHA [SHALEN]byte, peerId [IDLEN]byte) (*HandshakeMsg, error) {
 	// send HandshakeMsg
 	req := NewHandShakeMsg(infoSHA, peerId)
 	_, err := WriteHandShake(conn, req)
 	if err != nil {
-		fmt.Println("send handshake failed")
-		return err
+		return nil, err
 	}
 
 	// read HandshakeMsg
 	res, err := ReadHandshake(conn)
 	if err != nil {
-		fmt.Println("read handshake failed")
-		return err
+		return nil, err
 	}
 
 	// check HandshakeMsg
 	// 检查对方有的文件的类型是否和要下载的相同
 	if !bytes.Equal(res.InfoSHA[:], infoSHA[:]) {
-		fmt.Println("check handshake failed")
-		return fmt.Errorf("handshake msg error: " + string(res.InfoSHA[:]))
+		return nil, protocolErr("handshake", "unexpected info hash %x", res.InfoSHA)
 	}
-	return nil
+	return res, nil
 }
 
 // 从c发回的消息中获取bitfiled，即当前peer有哪些piece，每个piece用一个bit标识
+// 支持fast extension的peer会用HaveAll或HaveNone代替bitfield，没有任何piece的peer也可能什么都不发
 func fillBitfield(c *PeerConn) error {
-	c.SetDeadline(time.Now().Add(5 * time.Second))
+	c.SetDeadline(time.Now().Add(c.timeouts.withDefaults().Bitfield))
 	defer c.SetDeadline(time.Time{})
 
-	msg, err := c.ReadMsg()
-	if err != nil {
-		return err
+	var msg *PeerMsg
+	for msg == nil {
+		length, n, err := readLength(c)
+		if err != nil {
+			// 一个byte都没有收到就超时，说明对方没有任何piece
+			if n == 0 && isTimeout(err) {
+				c.Field = nil
+				return nil
+			}
+			return err
+		}
+		// keep alive msg
+		if length == 0 {
+			continue
+		}
+		msg, err = readBody(c, length, c.waitDown)
+		if err != nil {
+			return err
+		}
 	}
 
-	if msg == nil {
-		return fmt.Errorf("expected bitfield")
+	switch {
+	case msg.Id == MsgBitfield:
+		// 设置当前连接peer的bitfield
+		c.Field = msg.Payload
+	case c.fast && msg.Id == MsgHaveAll:
+		c.haveAll = true
+	case c.fast && msg.Id == MsgHaveNone:
+		c.Field = nil
+	case c.fast:
+		// 支持fast extension的peer第一条消息必须是这三种之一
+		return protocolErr(msg.Id.String(), "expected bitfield, have all or have none as the first message")
+	default:
+		// 对方没有piece时可以不发bitfield，这条消息之后正常处理
+		c.Field = nil
+		c.pending = msg
 	}
+	return nil
+}
 
-	if msg.Id != MsgBitfield {
-		return fmt.Errorf("expected bitfield, get" + strconv.Itoa(int(msg.Id)))
-	}
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
 
-	fmt.Println("fill bitfield: " + c.peer.Ip.String())
+// 读取消息，keep alive消息返回nil
+func (c *PeerConn) ReadMsg() (*PeerMsg, error) {
+	if c.pending != nil {
+		msg := c.pending
+		c.pending = nil
+		return msg, nil
+	}
 
-	// 设置当前连接peer的bitfield
-	c.Field = msg.Payload
-	return nil
+	return readMsg(c, c.waitDown)
 }
 
-func (c *PeerConn) ReadMsg() (*PeerMsg, error) {
-	// read msg length
-	lenBuf := make([]byte, 4)
-	_, err := io.ReadFull(c, lenBuf)
+// 从r中读取一条消息，keep alive消息返回nil
+func readMsg(r io.Reader, wait func(n int) error) (*PeerMsg, error) {
+	length, _, err := readLength(r)
 	if err != nil {
 		return nil, err
 	}
-	length := binary.BigEndian.Uint32(lenBuf)
 
 	// keep alive msg
 	if length == 0 {
 		return nil, nil
 	}
+	return readBody(r, length, wait)
+}
+
+// read msg length，同时返回实际读到的byte数
+func readLength(r io.Reader) (uint32, int, error) {
+	lenBuf := make([]byte, 4)
+	n, err := io.ReadFull(r, lenBuf)
+	if err != nil {
+		return 0, n, err
+	}
+	return binary.BigEndian.Uint32(lenBuf), n, nil
+}
+
+// 读取长度为length的消息，长度检查通过之后才分配内存
+// 如果是piece消息，读取数据之前先调用wait等待限速，wait可以为nil
+func readBody(r io.Reader, length uint32, wait func(n int) error) (*PeerMsg, error) {
+	if length > MaxMsgLen {
+		return nil, protocolErr("message", "length %d exceeds %d", length, MaxMsgLen)
+	}
 
 	// read msg body
-	msgBuf := make([]byte, length)
-	_, err = io.ReadFull(c, msgBuf)
+	// 先读出id，检查payload的长度
+	var id [1]byte
+	_, err := io.ReadFull(r, id[:])
 	if err != nil {
 		return nil, err
 	}
+	msg := &PeerMsg{Id: MsgId(id[0])}
+	err = checkPayloadLen(msg.Id, int(length)-1)
+	if err != nil {
+		return nil, err
+	}
+	if msg.Id == MsgPiece && wait != nil {
+		err = wait(int(length) - 1)
+		if err != nil {
+			return nil, err
+		}
+	}
+	msg.Payload = make([]byte, length-1)
+	_, err = io.ReadFull(r, msg.Payload)
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
 
-	return &PeerMsg{
-		Id:      MsgId(msgBuf[0]),
-		Payload: msgBuf[1:],
-	}, nil
+func (c *PeerConn) waitDown(n int) error {
+	return waitLimiters(c.limitCtx(), c.down, n)
 }
 
 const LenBytes uint32 = 4
 
+// m为nil时发送keep alive，只有值为0的长度
 func (c *PeerConn) WriteMsg(m *PeerMsg) (int, error) {
-	var buf []byte
+	if m != nil && m.Id == MsgPiece {
+		err := waitLimiters(c.limitCtx(), c.up, len(m.Payload))
+		if err != nil {
+			return 0, err
+		}
+	}
+	return c.writeMsg(m)
+}
+
+// 不经过上传限速直接写出消息
+func (c *PeerConn) writeMsg(m *PeerMsg) (int, error) {
 	if m == nil {
-		buf = make([]byte, LenBytes)
+		return c.Write(make([]byte, LenBytes))
 	}
 	length := uint32(len(m.Payload) + 1) // +1 for id
-	buf = make([]byte, LenBytes+length)
+	buf := make([]byte, LenBytes+length)
 	binary.BigEndian.PutUint32(buf[0:LenBytes], length)
 	buf[LenBytes] = byte(m.Id)
 	copy(buf[LenBytes+1:], m.Payload)
-
 	return c.Write(buf)
 }
 
+// 启动读循环和写循环，之后不能再直接调用ReadMsg和WriteMsg
+// 读循环在Idle时间内没有收到任何消息时断开，写循环在KeepAlive时间内没有发送消息时发送keep alive
+func (c *PeerConn) start() {
+	c.in = make(chan *PeerMsg)
+	c.outReady = make(chan struct{}, 1)
+	c.closed = make(chan struct{})
+	timeouts := c.timeouts.withDefaults()
+	go c.readLoop(timeouts.Idle)
+	go c.writeLoop(timeouts.KeepAlive)
+}
+
+// 读循环收到的消息，连接出错或者关闭时channel被关闭，原因由Err返回
+func (c *PeerConn) Incoming() <-chan *PeerMsg {
+	return c.in
+}
+
+// 将消息放入发送队列，不会阻塞，连接关闭之后放入的消息被丢弃
+func (c *PeerConn) Send(m *PeerMsg) {
+	c.outMu.Lock()
+	c.out = append(c.out, m)
+	c.outMu.Unlock()
+	select {
+	case c.outReady <- struct{}{}:
+	default:
+	}
+}
+
+// 从发送队列中删除还没有发送的piece消息，对方cancel请求时使用，返回是否删除了
+func (c *PeerConn) unsend(index, offset, length int) bool {
+	c.outMu.Lock()
+	defer c.outMu.Unlock()
+	for i, m := range c.out {
+		if m.Id != MsgPiece ||
+			int(binary.BigEndian.Uint32(m.Payload[0:4])) != index ||
+			int(binary.BigEndian.Uint32(m.Payload[4:8])) != offset ||
+			len(m.Payload)-8 != length {
+			continue
+		}
+		c.out = append(c.out[:i], c.out[i+1:]...)
+		return true
+	}
+	return false
+}
+
+// 读写循环退出的原因
+func (c *PeerConn) Err() error {
+	c.errMu.Lock()
+	defer c.errMu.Unlock()
+	return c.err
+}
+
+// 记录第一个错误并关闭连接，让另一个循环也退出
+func (c *PeerConn) fail(err error) {
+	c.errMu.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.errMu.Unlock()
+	c.Close()
+}
+
+func (c *PeerConn) Close() error {
+	c.closeOnce.Do(func() {
+		if c.closed != nil {
+			close(c.closed)
+		}
+	})
+	return c.Conn.Close()
+}
+
+func (c *PeerConn) readLoop(idle time.Duration) {
+	defer close(c.in)
+	for {
+		c.SetReadDeadline(time.Now().Add(idle))
+		msg, err := c.ReadMsg()
+		if err != nil {
+			if isTimeout(err) {
+				err = fmt.Errorf("%w: %w", ErrPeerIdle, err)
+			}
+			c.fail(err)
+			return
+		}
+		// keep alive只用来重置超时
+		if msg == nil {
+			continue
+		}
+		select {
+		case c.in <- msg:
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+// 从发送队列中取出所有非piece消息，take为true时再取出第一个piece消息
+// 控制消息因此不会排在被限速的piece后面
+func (c *PeerConn) takeOut(take bool) ([]*PeerMsg, *PeerMsg) {
+	c.outMu.Lock()
+	defer c.outMu.Unlock()
+	var ctrl []*PeerMsg
+	var piece *PeerMsg
+	rest := c.out[:0]
+	for _, m := range c.out {
+		switch {
+		case m.Id != MsgPiece:
+			ctrl = append(ctrl, m)
+		case take && piece == nil:
+			piece = m
+		default:
+			rest = append(rest, m)
+		}
+	}
+	for i := len(rest); i < len(c.out); i++ {
+		c.out[i] = nil
+	}
+	c.out = rest
+	return ctrl, piece
+}
+
+func (c *PeerConn) writeLoop(keepAlive time.Duration) {
+	timer := time.NewTimer(keepAlive)
+	defer timer.Stop()
+	ctx, cancel := context.WithCancel(c.limitCtx())
+	defer cancel()
+
+	// 正在等待上传限速的piece消息，同一时间只有一个，等待期间其他消息照常发送
+	var pacing *PeerMsg
+	var paced chan error
+	for {
+		ctrl, piece := c.takeOut(pacing == nil)
+		for _, m := range ctrl {
+			_, err := c.writeMsg(m)
+			if err != nil {
+				c.fail(err)
+				return
+			}
+		}
+		if piece != nil {
+			pacing = piece
+			paced = make(chan error, 1)
+			go func(done chan<- error, n int) {
+				done <- waitLimiters(ctx, c.up, n)
+			}(paced, len(piece.Payload))
+		}
+		if len(ctrl) > 0 {
+			resetTimer(timer, keepAlive)
+		}
+
+		select {
+		case <-c.outReady:
+		case err := <-paced:
+			if err == nil {
+				_, err = c.writeMsg(pacing)
+			}
+			if err != nil {
+				c.fail(err)
+				return
+			}
+			pacing, paced = nil, nil
+			resetTimer(timer, keepAlive)
+		case <-timer.C:
+			_, err := c.writeMsg(nil)
+			if err != nil {
+				c.fail(err)
+				return
+			}
+			timer.Reset(keepAlive)
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+func resetTimer(timer *time.Timer, d time.Duration) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+	timer.Reset(d)
+}
+
+// 从对方的peer id中识别出的客户端
+func (c *PeerConn) Client() ClientInfo {
+	return ParsePeerID(c.remoteId)
+}
+
+func (c *PeerConn) limitCtx() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
 func CopyPieceData(index int, buf []byte, msg *PeerMsg) (int, error) {
 	if msg.Id != MsgPiece {
 		return 0, fmt.Errorf("expected MsgPiece (Id %d), got Id %d", MsgPiece, msg.Id)
 	}
 
-	if len(msg.Payload) < 0 {
-		return 0, fmt.Errorf("payload too short. %d < 8", len(msg.Payload))
+	if len(msg.Payload) < 8 {
+		return 0, protocolErr(msg.Id.String(), "payload too short. %d < 8", len(msg.Payload))
 	}
 
 	parsedIdnex := int(binary.BigEndian.Uint32(msg.Payload[0:4]))
@@ -169,13 +595,58 @@ func GetHaveIndex(msg *PeerMsg) (int, error) {
 	}
 
 	if len(msg.Payload) != 4 {
-		return 0, fmt.Errorf("expected payload length 4, got length %d", len(msg.Payload))
+		return 0, protocolErr(msg.Id.String(), "expected payload length 4, got length %d", len(msg.Payload))
 	}
 
 	index := int(binary.BigEndian.Uint32(msg.Payload))
 	return index, nil
 }
 
+// 解析Reject消息，payload和Request消息相同
+func GetRejectInfo(msg *PeerMsg) (index, offset, length int, err error) {
+	if msg.Id != MsgReject {
+		return 0, 0, 0, fmt.Errorf("expected MsgReject (Id %d), got Id %d", MsgReject, msg.Id)
+	}
+
+	if len(msg.Payload) != 12 {
+		return 0, 0, 0, protocolErr(msg.Id.String(), "expected payload length 12, got length %d", len(msg.Payload))
+	}
+
+	index = int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+	offset = int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+	length = int(binary.BigEndian.Uint32(msg.Payload[8:12]))
+	return index, offset, length, nil
+}
+
+// 解析对方发来的Request和Cancel消息
+func GetRequestInfo(msg *PeerMsg) (index, offset, length int, err error) {
+	if msg.Id != MsgRequest && msg.Id != MsgCancel {
+		return 0, 0, 0, fmt.Errorf("expected MsgRequest or MsgCancel, got Id %d", msg.Id)
+	}
+
+	if len(msg.Payload) != 12 {
+		return 0, 0, 0, protocolErr(msg.Id.String(), "expected payload length 12, got length %d", len(msg.Payload))
+	}
+
+	index = int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+	offset = int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+	length = int(binary.BigEndian.Uint32(msg.Payload[8:12]))
+	return index, offset, length, nil
+}
+
+// 解析Suggest和AllowedFast消息，payload都只有piece的index
+func GetFastIndex(msg *PeerMsg) (int, error) {
+	if msg.Id != MsgSuggest && msg.Id != MsgAllowedFast {
+		return 0, fmt.Errorf("expected MsgSuggest or MsgAllowedFast, got Id %d", msg.Id)
+	}
+
+	if len(msg.Payload) != 4 {
+		return 0, protocolErr(msg.Id.String(), "expected payload length 4, got length %d", len(msg.Payload))
+	}
+
+	return int(binary.BigEndian.Uint32(msg.Payload)), nil
+}
+
 func NewRequestMsg(index, offset, length int) *PeerMsg {
 	payload := make([]byte, 12)
 	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
@@ -185,40 +656,157 @@ func NewRequestMsg(index, offset, length int) *PeerMsg {
 	return &PeerMsg{MsgRequest, payload}
 }
 
+func NewHaveMsg(index int) *PeerMsg {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(index))
+	return &PeerMsg{MsgHave, payload}
+}
+
 // PeerInfo为想要通信的peer的信息
 // infoSHA表示要下载文件的信息，相当于文件的唯一标识
 // peerId表示下载器客户端表示，这里用的是随机生成的
 func NewConn(peer PeerInfo, infoSHA [SHALEN]byte, peerId [IDLEN]byte) (*PeerConn, error) {
-	// setup tcp conn
+	return dialConn(context.Background(), peer, infoSHA, peerId, dialOptions{})
+}
+
+// 主动发起连接时的选项
+type dialOptions struct {
+	encryption EncryptionPolicy
+	utp        *utpSocket // 发起uTP连接使用的socket，为nil时为每个连接单独创建
+	timeouts   Timeouts
+}
+
+// 和NewConn相同，但是在ctx取消时会立即中断连接和握手的过程
+// 加密策略为EncryptionPrefer时先尝试MSE，失败后重新建立明文连接
+func dialConn(ctx context.Context, peer PeerInfo, infoSHA [SHALEN]byte, peerId [IDLEN]byte, opts dialOptions) (*PeerConn, error) {
+	c, err := dialPeer(ctx, peer, infoSHA, peerId, opts)
+	if err != nil && opts.encryption == EncryptionPrefer && ctx.Err() == nil {
+		opts.encryption = EncryptionDisable
+		return dialPeer(ctx, peer, infoSHA, peerId, opts)
+	}
+	return c, err
+}
+
+func dialPeer(ctx context.Context, peer PeerInfo, infoSHA [SHALEN]byte, peerId [IDLEN]byte, opts dialOptions) (*PeerConn, error) {
+	// setup conn，先尝试uTP，再使用TCP
 	addr := net.JoinHostPort(peer.Ip.String(), strconv.Itoa(int(peer.Port)))
-	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	timeouts := opts.timeouts.withDefaults()
+	conn, err := dialTransport(ctx, addr, opts.utp, timeouts.Dial)
 	if err != nil {
-		fmt.Println("set tcp conn failed: " + addr)
+		return nil, err
+	}
+
+	// 握手过程中ctx取消时关闭连接，让阻塞的读写立即返回
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+
+	// MSE握手，之后的BitTorrent握手和消息都经过加密
+	conn.SetDeadline(time.Now().Add(timeouts.Handshake))
+	var stream net.Conn = conn
+	switch opts.encryption {
+	case EncryptionPrefer:
+		stream, err = mseInitiate(conn, infoSHA, cryptoRC4|cryptoPlain)
+	case EncryptionRequire:
+		stream, err = mseInitiate(conn, infoSHA, cryptoRC4)
+	}
+	if err != nil {
+		conn.Close()
 		return nil, err
 	}
 
 	// torrent p2p handshake
 	// 经过handshake，conn中已经是建立好并通过握手的连接了
-	err = handshake(conn, infoSHA, peerId)
+	res, err := handshake(stream, infoSHA, peerId)
 	if err != nil {
-		fmt.Println("handshake failed")
 		conn.Close()
 		return nil, err
 	}
+	conn.SetDeadline(time.Time{})
 
 	c := &PeerConn{
-		Conn:    conn, // 将c中的Conn设置为已经建立连接的conn
-		Chocked: true, // 对方默认是chock的，即不愿意上传，等待对方的unchock，表示对方愿意上传再进行通信
-		peer:    peer,
-		peerId:  peerId,
-		infoSHA: infoSHA,
+		Conn:     stream, // 将c中的Conn设置为已经建立连接的conn
+		Chocked:  true,   // 对方默认是chock的，即不愿意上传，等待对方的unchock，表示对方愿意上传再进行通信
+		peer:     peer,
+		peerId:   peerId,
+		infoSHA:  infoSHA,
+		remoteId: res.PeerId,
+		fast:     res.SupportsFast(),
+		timeouts: timeouts,
 	}
 
 	// fill bitfield
 	err = fillBitfield(c)
 	if err != nil {
-		fmt.Println("fill bitfield failed, " + err.Error())
+		conn.Close()
 		return nil, err
 	}
 	return c, nil
 }
+
+// 处理对方主动发起的连接，先读取对方的握手，确认是infoHashes中的文件后再回复握手
+// 对方使用MSE时按policy决定是否接受，握手中的info hash必须和MSE的SKEY相同
+func acceptConn(conn net.Conn, peerId [IDLEN]byte, policy EncryptionPolicy, timeouts Timeouts, infoHashes func() [][SHALEN]byte) (*PeerConn, error) {
+	timeouts = timeouts.withDefaults()
+	conn.SetDeadline(time.Now().Add(timeouts.Handshake))
+	defer conn.SetDeadline(time.Time{})
+
+	conn, skey, err := mseAccept(conn, policy, infoHashes)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := ReadHandshake(conn)
+	if err != nil {
+		return nil, err
+	}
+	if skey != nil && *skey != res.InfoSHA {
+		return nil, fmt.Errorf("info hash does not match mse skey: %x", res.InfoSHA)
+	}
+	known := false
+	for _, h := range infoHashes() {
+		known = known || h == res.InfoSHA
+	}
+	if !known {
+		return nil, fmt.Errorf("unknown info hash: %x", res.InfoSHA)
+	}
+
+	_, err = WriteHandShake(conn, NewHandShakeMsg(res.InfoSHA, peerId))
+	if err != nil {
+		return nil, err
+	}
+
+	c := &PeerConn{
+		Conn:     conn,
+		Chocked:  true,
+		peer:     addrPeer(conn.RemoteAddr()),
+		peerId:   peerId,
+		infoSHA:  res.InfoSHA,
+		remoteId: res.PeerId,
+		fast:     res.SupportsFast(),
+		timeouts: timeouts,
+	}
+
+	err = fillBitfield(c)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// 对方的地址，对方可能通过TCP或者uTP连接
+func addrPeer(addr net.Addr) PeerInfo {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return PeerInfo{Ip: addr.IP, Port: uint16(addr.Port)}
+	case *net.UDPAddr:
+		return PeerInfo{Ip: addr.IP, Port: uint16(addr.Port)}
+	}
+	return PeerInfo{}
+}
@@ -2,11 +2,18 @@ package torrent
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
 	"fmt"
+	"io"
 	"math/rand"
 	"net"
 	"os"
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestPeer(t *testing.T) {
@@ -26,3 +33,178 @@ func TestPeer(t *testing.T) {
 	}
 	fmt.Println(conn)
 }
+
+func TestFillBitfieldFast(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	w := &PeerConn{Conn: a}
+
+	// fast extension的peer用HaveAll代替bitfield
+	c := &PeerConn{Conn: b, fast: true}
+	go w.WriteMsg(&PeerMsg{MsgHaveAll, nil})
+	assert.Equal(t, nil, fillBitfield(c))
+	assert.True(t, c.haveAll)
+
+	c = &PeerConn{Conn: b, fast: true}
+	go w.WriteMsg(&PeerMsg{MsgHaveNone, nil})
+	assert.Equal(t, nil, fillBitfield(c))
+	assert.False(t, c.Field.HasPiece(0))
+
+	// 没有piece的普通peer直接发送其他消息，这条消息之后由ReadMsg返回
+	c = &PeerConn{Conn: b}
+	go w.WriteMsg(&PeerMsg{MsgUnchoke, nil})
+	assert.Equal(t, nil, fillBitfield(c))
+	msg, err := c.ReadMsg()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, MsgUnchoke, msg.Id)
+
+	// 不支持fast extension时HaveAll不能代替bitfield
+	var hs HandshakeMsg
+	assert.False(t, hs.SupportsFast())
+	assert.True(t, NewHandShakeMsg(hs.InfoSHA, hs.PeerId).SupportsFast())
+}
+
+func TestReadMsgValidation(t *testing.T) {
+	var perr *ProtocolError
+	msg := func(length uint32, body ...byte) []byte {
+		buf := binary.BigEndian.AppendUint32(nil, length)
+		return append(buf, body...)
+	}
+
+	// 长度过大时不读取也不分配后面的数据
+	_, err := readMsg(bytes.NewReader(msg(0xffffffff)), nil)
+	assert.ErrorAs(t, err, &perr)
+
+	// 每种消息的payload长度
+	_, err = readMsg(bytes.NewReader(msg(3, byte(MsgHave), 0, 0)), nil)
+	assert.ErrorAs(t, err, &perr)
+	_, err = readMsg(bytes.NewReader(msg(2, byte(MsgUnchoke), 0)), nil)
+	assert.ErrorAs(t, err, &perr)
+	_, err = readMsg(bytes.NewReader(msg(5, byte(MsgPiece), 0, 0, 0, 0)), nil)
+	assert.ErrorAs(t, err, &perr)
+
+	// 不认识的消息可以读出来，由调用者忽略
+	m, err := readMsg(bytes.NewReader(msg(3, 20, 'x', 'y')), nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, &PeerMsg{MsgId(20), []byte("xy")}, m)
+
+	// payload太短的piece消息返回错误，而不是panic
+	_, err = CopyPieceData(0, make([]byte, 16), &PeerMsg{MsgPiece, []byte{0, 0, 0, 0}})
+	assert.ErrorAs(t, err, &perr)
+}
+
+func TestCheckBitfield(t *testing.T) {
+	assert.Equal(t, nil, checkBitfield(Bitfield{0xff, 0xc0}, 10))
+	// 长度不对
+	assert.NotEqual(t, nil, checkBitfield(Bitfield{0xff}, 10))
+	assert.NotEqual(t, nil, checkBitfield(Bitfield{0xff, 0xc0, 0}, 10))
+	// 多出来的bit不为0
+	assert.NotEqual(t, nil, checkBitfield(Bitfield{0xff, 0xe0}, 10))
+	assert.Equal(t, nil, checkBitfield(Bitfield{0xff}, 8))
+}
+
+func TestWriteMsgKeepAlive(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	go (&PeerConn{Conn: a}).WriteMsg(nil)
+	msg, err := (&PeerConn{Conn: b}).ReadMsg()
+	assert.Equal(t, nil, err)
+	assert.Nil(t, msg)
+}
+
+func FuzzReadMsg(f *testing.F) {
+	f.Add([]byte{0, 0, 0, 0})
+	f.Add([]byte{0, 0, 0, 5, byte(MsgHave), 0, 0, 0, 1})
+	f.Add([]byte{0, 0, 0, 2, byte(MsgBitfield), 0x80})
+	f.Add([]byte{0, 0, 0, 13, byte(MsgRequest), 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0x40, 0})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := bytes.NewReader(data)
+		for {
+			msg, err := readMsg(r, nil)
+			if err != nil {
+				return
+			}
+			if msg == nil {
+				continue
+			}
+			// 读出来的消息一定满足长度限制，解析时不会出错
+			assert.Equal(t, nil, checkPayloadLen(msg.Id, len(msg.Payload)))
+			switch msg.Id {
+			case MsgHave:
+				_, err = GetHaveIndex(msg)
+			case MsgReject:
+				_, _, _, err = GetRejectInfo(msg)
+			case MsgSuggest, MsgAllowedFast:
+				_, err = GetFastIndex(msg)
+			case MsgPiece:
+				// offset可能超出范围，只要求不panic
+				CopyPieceData(int(binary.BigEndian.Uint32(msg.Payload)), make([]byte, MaxBlockLen), msg)
+			}
+			assert.Equal(t, nil, err)
+		}
+	})
+}
+
+func TestPeerConnLoops(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	c := &PeerConn{Conn: a, timeouts: Timeouts{Idle: time.Second, KeepAlive: 40 * time.Millisecond}}
+	c.start()
+
+	// 放入队列的消息按顺序发送，之后一直没有消息时定时发送keep alive
+	c.Send(&PeerMsg{MsgInterested, nil})
+	c.Send(&PeerMsg{MsgHave, []byte{0, 0, 0, 1}})
+	r := &PeerConn{Conn: b}
+	var got []*PeerMsg
+	for i := 0; i < 4; i++ {
+		b.SetReadDeadline(time.Now().Add(time.Second))
+		msg, err := r.ReadMsg()
+		assert.Equal(t, nil, err)
+		got = append(got, msg)
+	}
+	assert.Equal(t, []*PeerMsg{{MsgInterested, []byte{}}, {MsgHave, []byte{0, 0, 0, 1}}, nil, nil}, got)
+
+	// 收到的消息从Incoming读出，keep alive不会出现
+	go func() {
+		r.WriteMsg(nil)
+		r.WriteMsg(&PeerMsg{MsgUnchoke, nil})
+		b.Close()
+	}()
+	assert.Equal(t, &PeerMsg{MsgUnchoke, []byte{}}, <-c.Incoming())
+	_, ok := <-c.Incoming()
+	assert.False(t, ok)
+	assert.ErrorIs(t, c.Err(), io.EOF)
+}
+
+func TestPeerConnThrottledUpload(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	l := NewLimiter(1)
+	l.WaitN(context.Background(), 1000)
+	c := &PeerConn{Conn: a, up: []*Limiter{l}, timeouts: Timeouts{Idle: time.Second, KeepAlive: time.Second}}
+	c.start()
+	defer c.Close()
+
+	// piece在等待上传限速，之后放入的have不用等它
+	c.Send(&PeerMsg{MsgPiece, make([]byte, 8+16)})
+	time.Sleep(20 * time.Millisecond)
+	c.Send(&PeerMsg{MsgHave, []byte{0, 0, 0, 1}})
+	r := &PeerConn{Conn: b}
+	b.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	msg, err := r.ReadMsg()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, &PeerMsg{MsgHave, []byte{0, 0, 0, 1}}, msg)
+}
+
+func TestPeerConnIdle(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	c := &PeerConn{Conn: a, timeouts: Timeouts{Idle: 50 * time.Millisecond}}
+	c.start()
+	go io.Copy(io.Discard, b)
+	_, ok := <-c.Incoming()
+	assert.False(t, ok)
+	assert.ErrorIs(t, c.Err(), ErrPeerIdle)
+}
@@ -0,0 +1,162 @@
+package torrent
+
+import (
+	"crypto/rand"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// 本客户端的peer id前缀，Azureus风格，GT表示go-torrent，0001为版本号
+const DefaultPeerIDPrefix = "-GT0001-"
+
+// peer id中prefix之后的随机部分使用的字符，只用可打印字符，方便在日志中查看
+const peerIdChars = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+// 生成peer id，prefix之后用随机字符填充，prefix为空时使用DefaultPeerIDPrefix
+// tracker和peer通过prefix识别客户端，有些private tracker只允许特定的客户端
+func NewPeerID(prefix string) ([IDLEN]byte, error) {
+	var id [IDLEN]byte
+	if prefix == "" {
+		prefix = DefaultPeerIDPrefix
+	}
+	if len(prefix) > IDLEN {
+		return id, fmt.Errorf("peer id prefix too long: %d > %d", len(prefix), IDLEN)
+	}
+	n := copy(id[:], prefix)
+	_, err := rand.Read(id[n:])
+	if err != nil {
+		return id, err
+	}
+	for i := n; i < IDLEN; i++ {
+		id[i] = peerIdChars[int(id[i])%len(peerIdChars)]
+	}
+	return id, nil
+}
+
+// 从peer id中解析出的客户端信息，无法识别时Name为空
+type ClientInfo struct {
+	Name    string
+	Version string
+}
+
+func (c ClientInfo) String() string {
+	if c.Name == "" {
+		return "unknown"
+	}
+	if c.Version == "" {
+		return c.Name
+	}
+	return c.Name + " " + c.Version
+}
+
+// Azureus风格的客户端代码，-XX1234-，只列出常见的
+var azureusClients = map[string]string{
+	"AG": "Ares",
+	"AZ": "Vuze",
+	"BC": "BitComet",
+	"BI": "BiglyBT",
+	"BT": "BitTorrent",
+	"DE": "Deluge",
+	"FD": "Free Download Manager",
+	"GT": "go-torrent",
+	"KT": "KTorrent",
+	"LT": "libtorrent",
+	"lt": "libTorrent",
+	"qB": "qBittorrent",
+	"SD": "Thunder",
+	"TL": "Tribler",
+	"TR": "Transmission",
+	"UM": "µTorrent Mac",
+	"UT": "µTorrent",
+	"WW": "WebTorrent",
+	"XL": "Xunlei",
+}
+
+// Shadow风格的客户端代码，第一个字符表示客户端
+var shadowClients = map[byte]string{
+	'A': "ABC",
+	'O': "Osprey Permaseed",
+	'Q': "BTQueue",
+	'R': "Tribler",
+	'S': "Shadow",
+	'T': "BitTornado",
+	'U': "UPnP NAT Bit Torrent",
+}
+
+// 解析对方握手中的peer id，支持Azureus风格(-XX1234-)和Shadow风格(S58B-----)
+func ParsePeerID(id [IDLEN]byte) ClientInfo {
+	if info, ok := parseAzureus(id); ok {
+		return info
+	}
+	if info, ok := parseShadow(id); ok {
+		return info
+	}
+	return ClientInfo{}
+}
+
+// -XX1234-，XX为客户端代码，1234为版本号，每个字符是版本号的一段
+func parseAzureus(id [IDLEN]byte) (ClientInfo, bool) {
+	if id[0] != '-' || id[7] != '-' {
+		return ClientInfo{}, false
+	}
+	code := string(id[1:3])
+	if !isAlnum(code[0]) || !isAlnum(code[1]) {
+		return ClientInfo{}, false
+	}
+	parts := make([]string, 0, 4)
+	for _, b := range id[3:7] {
+		v := shadowDigit(b)
+		if v < 0 || v > 35 {
+			return ClientInfo{}, false
+		}
+		parts = append(parts, strconv.Itoa(v))
+	}
+	name, ok := azureusClients[code]
+	if !ok {
+		name = code
+	}
+	return ClientInfo{name, strings.Join(parts, ".")}, true
+}
+
+// 第一个字符为客户端，之后最多5个字符为版本号，不足时用'-'填充，再之后通常是"---"
+func parseShadow(id [IDLEN]byte) (ClientInfo, bool) {
+	name, ok := shadowClients[id[0]]
+	if !ok || string(id[6:9]) != "---" {
+		return ClientInfo{}, false
+	}
+	var parts []string
+	for _, b := range id[1:6] {
+		if b == '-' {
+			break
+		}
+		v := shadowDigit(b)
+		if v < 0 {
+			return ClientInfo{}, false
+		}
+		parts = append(parts, strconv.Itoa(v))
+	}
+	if len(parts) == 0 {
+		return ClientInfo{}, false
+	}
+	return ClientInfo{name, strings.Join(parts, ".")}, true
+}
+
+// Shadow风格中版本号的每个字符，0-9、A-Z、a-z、'.'依次表示0到62，无效时返回-1
+func shadowDigit(b byte) int {
+	switch {
+	case b >= '0' && b <= '9':
+		return int(b - '0')
+	case b >= 'A' && b <= 'Z':
+		return int(b-'A') + 10
+	case b >= 'a' && b <= 'z':
+		return int(b-'a') + 36
+	case b == '.':
+		return 62
+	}
+	return -1
+}
+
+func isAlnum(b byte) bool {
+	return shadowDigit(b) >= 0 && b != '.'
+}
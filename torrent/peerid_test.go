@@ -0,0 +1,49 @@
+package torrent
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func peerId(s string) [IDLEN]byte {
+	var id [IDLEN]byte
+	copy(id[:], s)
+	return id
+}
+
+func TestNewPeerID(t *testing.T) {
+	id, err := NewPeerID("")
+	assert.Equal(t, nil, err)
+	assert.True(t, strings.HasPrefix(string(id[:]), DefaultPeerIDPrefix))
+	assert.Equal(t, ClientInfo{"go-torrent", "0.0.0.1"}, ParsePeerID(id))
+
+	// 随机部分不同
+	other, _ := NewPeerID("")
+	assert.NotEqual(t, id, other)
+
+	_, err = NewPeerID(strings.Repeat("x", IDLEN+1))
+	assert.NotEqual(t, nil, err)
+}
+
+func TestParsePeerID(t *testing.T) {
+	cases := []struct {
+		id   string
+		want ClientInfo
+	}{
+		{"-qB4250-abcdefghijkl", ClientInfo{"qBittorrent", "4.2.5.0"}},
+		{"-TR294Z-abcdefghijkl", ClientInfo{"Transmission", "2.9.4.35"}},
+		{"-XY0100-abcdefghijkl", ClientInfo{"XY", "0.1.0.0"}},
+		{"S58B-----abcdefghijk", ClientInfo{"Shadow", "5.8.11"}},
+		{"T03I-----abcdefghijk", ClientInfo{"BitTornado", "0.3.18"}},
+		{"M4-4-0--abcdefghijkl", ClientInfo{}},
+		{"-qB42.0-abcdefghijkl", ClientInfo{}},
+		{"S------abcdefghijklm", ClientInfo{}},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.want, ParsePeerID(peerId(c.id)), c.id)
+	}
+	assert.Equal(t, "unknown", ClientInfo{}.String())
+	assert.Equal(t, "Shadow 5.8.11", ClientInfo{"Shadow", "5.8.11"}.String())
+}
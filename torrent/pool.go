@@ -0,0 +1,186 @@
+package torrent
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 和已经连接的peer的peer id相同，同一个peer只保留一个连接
+var ErrDuplicatePeer = errors.New("duplicate peer")
+
+// 每个任务同时连接的peer数量的默认上限
+const DefaultMaxPeers = 50
+
+// 连接失败或者断开的peer的重试策略，为0的项使用DefaultRetry中的值
+type RetryPolicy struct {
+	Attempts   int           // 一个peer最多失败多少次，之后不再连接
+	Backoff    time.Duration // 第一次失败之后等待多久再重新连接，之后每次翻倍
+	MaxBackoff time.Duration // 等待时间的上限
+}
+
+var DefaultRetry = RetryPolicy{
+	Attempts:   5,
+	Backoff:    5 * time.Second,
+	MaxBackoff: 5 * time.Minute,
+}
+
+func (r RetryPolicy) withDefaults() RetryPolicy {
+	if r.Attempts <= 0 {
+		r.Attempts = DefaultRetry.Attempts
+	}
+	if r.Backoff <= 0 {
+		r.Backoff = DefaultRetry.Backoff
+	}
+	if r.MaxBackoff <= 0 {
+		r.MaxBackoff = DefaultRetry.MaxBackoff
+	}
+	return r
+}
+
+// 第n次失败之后的等待时间
+func (r RetryPolicy) backoff(n int) time.Duration {
+	d := r.Backoff
+	for i := 1; i < n && d < r.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > r.MaxBackoff {
+		d = r.MaxBackoff
+	}
+	return d
+}
+
+// 候选的peer，按地址去重
+type poolPeer struct {
+	info     PeerInfo
+	failures int
+	retryAt  time.Time // 失败之后下一次可以连接的时间
+	active   bool      // 正在连接或者已经连上
+}
+
+// 一个任务的peer池，tracker或者其他来源得到的peer都放到这里，由Download从中选出可以连接的peer
+type peerPool struct {
+	mu     sync.Mutex
+	peers  map[string]*poolPeer // ip:port -> peer
+	order  []*poolPeer          // 先加入的先连接
+	ids    map[[IDLEN]byte]bool // 已经完成握手的peer的id
+	notify chan struct{}        // 有等待者时不为nil，有新的peer加入时关闭
+}
+
+func newPeerPool() *peerPool {
+	return &peerPool{
+		peers: make(map[string]*poolPeer),
+		ids:   make(map[[IDLEN]byte]bool),
+	}
+}
+
+func peerAddr(peer PeerInfo) string {
+	return net.JoinHostPort(peer.Ip.String(), strconv.Itoa(int(peer.Port)))
+}
+
+// 加入新的peer，已经有的地址被忽略，返回新加入的数量
+func (p *peerPool) add(peers ...PeerInfo) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := 0
+	for _, peer := range peers {
+		addr := peerAddr(peer)
+		if _, ok := p.peers[addr]; ok {
+			continue
+		}
+		pp := &poolPeer{info: peer}
+		p.peers[addr] = pp
+		p.order = append(p.order, pp)
+		n++
+	}
+	if n > 0 && p.notify != nil {
+		close(p.notify)
+		p.notify = nil
+	}
+	return n
+}
+
+// 有新的peer加入时会被关闭的channel
+func (p *peerPool) wait() <-chan struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.notify == nil {
+		p.notify = make(chan struct{})
+	}
+	return p.notify
+}
+
+// 取出一个现在可以连接的peer并标记为active，skip中的peer不连接
+// 没有时返回还在等待重试的peer中最早可以连接的时间，没有等待重试的peer时为零值
+func (p *peerPool) next(now time.Time, retry RetryPolicy, skip func(PeerInfo) bool) (*poolPeer, time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var wake time.Time
+	for _, pp := range p.order {
+		if pp.active || pp.failures >= retry.Attempts || skip(pp.info) {
+			continue
+		}
+		if pp.retryAt.After(now) {
+			if wake.IsZero() || pp.retryAt.Before(wake) {
+				wake = pp.retryAt
+			}
+			continue
+		}
+		pp.active = true
+		return pp, time.Time{}
+	}
+	return nil, wake
+}
+
+// peer退出，出错时等待一段时间再重试，被ban的peer不再连接
+// 重复的peer同样等待之后重试，原来的连接断开之后这个地址仍然可能有用
+func (p *peerPool) release(pp *poolPeer, err error, retry RetryPolicy) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pp.active = false
+	switch {
+	case err == nil || errors.Is(err, context.Canceled):
+	case errors.Is(err, ErrPeerBanned):
+		pp.failures = retry.Attempts
+	default:
+		pp.failures++
+		pp.retryAt = time.Now().Add(retry.backoff(pp.failures))
+	}
+}
+
+// 重新开始下载时清空失败的记录
+func (p *peerPool) reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, pp := range p.order {
+		pp.failures = 0
+		pp.retryAt = time.Time{}
+	}
+}
+
+// 记录完成握手的peer的id，已经有相同id的连接时返回false
+func (p *peerPool) register(id [IDLEN]byte) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.ids[id] {
+		return false
+	}
+	p.ids[id] = true
+	return true
+}
+
+func (p *peerPool) unregister(id [IDLEN]byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.ids, id)
+}
+
+// 加入可以连接的peer，可以在下载过程中随时调用，比如重新向tracker请求之后
+// 已经有的地址会被忽略，返回新加入的数量
+func (t *TorrentTask) AddPeers(peers ...PeerInfo) int {
+	t.init()
+	return t.pool.add(peers...)
+}
@@ -0,0 +1,177 @@
+package torrent
+
+import (
+	"context"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPeerPool(t *testing.T) {
+	p := newPeerPool()
+	a := PeerInfo{Ip: net.ParseIP("10.0.0.1"), Port: 6881}
+	b := PeerInfo{Ip: net.ParseIP("10.0.0.2"), Port: 6881}
+	wait := p.wait()
+	// 按地址去重
+	assert.Equal(t, 2, p.add(a, b, a))
+	assert.Equal(t, 0, p.add(PeerInfo{Ip: net.ParseIP("10.0.0.1"), Port: 6881}))
+	<-wait
+
+	retry := RetryPolicy{Attempts: 2, Backoff: time.Second, MaxBackoff: time.Second}
+	none := func(PeerInfo) bool { return false }
+	now := time.Now()
+	pa, _ := p.next(now, retry, none)
+	assert.Equal(t, a, pa.info)
+	pb, _ := p.next(now, retry, none)
+	assert.Equal(t, b, pb.info)
+	pp, wake := p.next(now, retry, none)
+	assert.Nil(t, pp)
+	assert.True(t, wake.IsZero())
+
+	// 失败之后等待backoff再重试，达到Attempts之后不再连接
+	p.release(pa, ErrPeerIdle, retry)
+	pp, wake = p.next(time.Now(), retry, none)
+	assert.Nil(t, pp)
+	assert.False(t, wake.IsZero())
+	pp, _ = p.next(wake, retry, none)
+	assert.Equal(t, pa, pp)
+	p.release(pa, ErrPeerIdle, retry)
+	pp, wake = p.next(time.Now().Add(time.Hour), retry, none)
+	assert.Nil(t, pp)
+	assert.True(t, wake.IsZero())
+
+	// 被ban的peer不再重试
+	p.release(pb, ErrPeerBanned, retry)
+	pp, _ = p.next(time.Now().Add(time.Hour), retry, none)
+	assert.Nil(t, pp)
+
+	// 重复的peer和其他错误一样等待之后重试
+	p.reset()
+	pp, _ = p.next(time.Now(), retry, none)
+	assert.Equal(t, pa, pp)
+	p.release(pa, ErrDuplicatePeer, retry)
+	pp, wake = p.next(time.Now(), retry, func(peer PeerInfo) bool { return peer.Ip.Equal(b.Ip) })
+	assert.Nil(t, pp)
+	assert.False(t, wake.IsZero())
+	pp, _ = p.next(wake, retry, none)
+	assert.Equal(t, pa, pp)
+	p.release(pa, ErrDuplicatePeer, retry)
+
+	// 重新下载时清空失败的记录
+	p.reset()
+	pp, _ = p.next(time.Now(), retry, func(peer PeerInfo) bool { return peer.Ip.Equal(a.Ip) })
+	assert.Equal(t, pb, pp)
+
+	var id [IDLEN]byte
+	assert.True(t, p.register(id))
+	assert.False(t, p.register(id))
+	p.unregister(id)
+	assert.True(t, p.register(id))
+}
+
+func TestRetryBackoff(t *testing.T) {
+	r := RetryPolicy{Backoff: time.Second, MaxBackoff: 5 * time.Second}.withDefaults()
+	assert.Equal(t, DefaultRetry.Attempts, r.Attempts)
+	assert.Equal(t, time.Second, r.backoff(1))
+	assert.Equal(t, 4*time.Second, r.backoff(3))
+	assert.Equal(t, 5*time.Second, r.backoff(10))
+}
+
+func TestDownloadRetry(t *testing.T) {
+	data := []byte("0123456789")
+	// 第一次连接时握手之后立即断开，之后正常提供数据
+	var conns atomic.Int32
+	peer := listenPeer(t, func(c *PeerConn) {
+		if conns.Add(1) == 1 {
+			c.Close()
+			return
+		}
+		serveSeeder(c.Conn, data, len(data))
+	})
+	task := newTestTask(t, []PeerInfo{peer})
+	task.Retry = RetryPolicy{Attempts: 3, Backoff: 50 * time.Millisecond}
+	assert.Equal(t, nil, Download(context.Background(), task))
+	got, _ := os.ReadFile(task.FileName)
+	assert.Equal(t, data, got)
+	assert.Equal(t, int32(2), conns.Load())
+}
+
+func TestDownloadReplacePeer(t *testing.T) {
+	data := []byte("0123456789")
+	var served atomic.Bool
+	good := listenPeer(t, func(c *PeerConn) {
+		served.Store(true)
+		serveSeeder(c.Conn, data, len(data))
+	})
+
+	// 同时只能连接一个peer，不响应的peer断开之后换成下载过程中加入的peer
+	task := newTestTask(t, []PeerInfo{stallPeer(t)})
+	task.MaxPeers = 1
+	task.Timeouts = Timeouts{Idle: 200 * time.Millisecond}
+	task.Retry = RetryPolicy{Attempts: 1}
+	var once sync.Once
+	task.Observer = ObserverFunc(func(e Event) {
+		if e.Type != EventPeerConnected {
+			return
+		}
+		// 第一个peer连上之后才加入，在它断开之前不能连接
+		once.Do(func() {
+			assert.Equal(t, 1, task.AddPeers(good))
+			time.Sleep(50 * time.Millisecond)
+			assert.False(t, served.Load())
+		})
+	})
+	assert.Equal(t, nil, Download(context.Background(), task))
+	got, _ := os.ReadFile(task.FileName)
+	assert.Equal(t, data, got)
+}
+
+func TestDownloadDuplicatePeer(t *testing.T) {
+	// 两个地址上的是同一个peer，完成握手之后不再响应
+	id, _ := NewPeerID("-TS0001-")
+	var conns atomic.Int32
+	listen := func() PeerInfo {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.Equal(t, nil, err)
+		t.Cleanup(func() { ln.Close() })
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				hs, err := ReadHandshake(conn)
+				if err != nil {
+					conn.Close()
+					continue
+				}
+				conns.Add(1)
+				WriteHandShake(conn, NewHandShakeMsg(hs.InfoSHA, id))
+				t.Cleanup(func() { conn.Close() })
+				go (&PeerConn{Conn: conn}).WriteMsg(&PeerMsg{MsgBitfield, []byte{0x80}})
+			}
+		}()
+		addr := ln.Addr().(*net.TCPAddr)
+		return PeerInfo{Ip: addr.IP, Port: uint16(addr.Port)}
+	}
+
+	task := newTestTask(t, []PeerInfo{listen(), listen()})
+	task.Timeouts = Timeouts{Idle: 300 * time.Millisecond}
+	task.Retry = RetryPolicy{Attempts: 1}
+	var connected atomic.Int32
+	task.Observer = ObserverFunc(func(e Event) {
+		if e.Type == EventPeerConnected {
+			connected.Add(1)
+		}
+	})
+	err := Download(context.Background(), task)
+	assert.ErrorIs(t, err, ErrNoPeers)
+	// 两个连接都完成了握手，其中一个因为peer id重复而断开
+	assert.Equal(t, int32(2), conns.Load())
+	assert.Equal(t, int32(1), connected.Load())
+}
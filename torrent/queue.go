@@ -0,0 +1,101 @@
+package torrent
+
+import "sync"
+
+// 待下载piece的队列，替代原来的channel
+// channel只能从尾部放入，无法把某些piece提到最前面，也无法只取出对方peer拥有的piece
+type pieceQueue struct {
+	mu     sync.Mutex
+	tasks  []*pieceTask
+	prio   map[int]bool // 被提前的piece，reset之后重新放入时仍然排在前面
+	closed bool
+	notify chan struct{} // 有等待者时不为nil，队列有变化时关闭
+}
+
+func newPieceQueue() *pieceQueue {
+	return &pieceQueue{prio: make(map[int]bool)}
+}
+
+// 放回队列尾部，被提前过的piece放到其他被提前的piece之后
+func (q *pieceQueue) push(task *pieceTask) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return
+	}
+	pos := len(q.tasks)
+	if q.prio[task.index] {
+		pos = 0
+		for pos < len(q.tasks) && q.prio[q.tasks[pos].index] {
+			pos++
+		}
+	}
+	q.tasks = append(q.tasks, nil)
+	copy(q.tasks[pos+1:], q.tasks[pos:])
+	q.tasks[pos] = task
+	q.wake()
+}
+
+// 取出第一个满足has的task，没有时返回一个channel，有task放入或者队列关闭时会被关闭
+// 用于在select中等待。队列已经关闭时closed为true
+func (q *pieceQueue) poll(has func(index int) bool) (task *pieceTask, changed <-chan struct{}, closed bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return nil, nil, true
+	}
+	for i, task := range q.tasks {
+		if has(task.index) {
+			q.tasks = append(q.tasks[:i], q.tasks[i+1:]...)
+			return task, nil, false
+		}
+	}
+	if q.notify == nil {
+		q.notify = make(chan struct{})
+	}
+	return nil, q.notify, false
+}
+
+// 唤醒poll的等待者，调用时要持有锁
+func (q *pieceQueue) wake() {
+	if q.notify != nil {
+		close(q.notify)
+		q.notify = nil
+	}
+}
+
+// 将index在[begin, end)中的task移到队列最前面，保持它们原有的相对顺序
+func (q *pieceQueue) prioritize(begin, end int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i := begin; i < end; i++ {
+		q.prio[i] = true
+	}
+	front := make([]*pieceTask, 0, len(q.tasks))
+	back := make([]*pieceTask, 0, len(q.tasks))
+	for _, task := range q.tasks {
+		if task.index >= begin && task.index < end {
+			front = append(front, task)
+		} else {
+			back = append(back, task)
+		}
+	}
+	q.tasks = append(front, back...)
+}
+
+// 清空并重新打开队列，用于再次开始下载，之前提前的piece仍然有效
+func (q *pieceQueue) reset() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = false
+	q.tasks = nil
+}
+
+// 关闭队列，唤醒所有等待的go routine
+func (q *pieceQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.tasks = nil
+	q.wake()
+}
@@ -0,0 +1,72 @@
+package torrent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 取出满足has的task，没有时等待，队列关闭后返回nil
+func pollWait(q *pieceQueue, has func(index int) bool) *pieceTask {
+	for {
+		task, changed, closed := q.poll(has)
+		if task != nil || closed {
+			return task
+		}
+		<-changed
+	}
+}
+
+func TestPieceQueuePrioritize(t *testing.T) {
+	q := newPieceQueue()
+	for i := 0; i < 5; i++ {
+		q.push(&pieceTask{index: i})
+	}
+	q.prioritize(3, 5)
+	all := func(int) bool { return true }
+	var order []int
+	for i := 0; i < 5; i++ {
+		order = append(order, pollWait(q, all).index)
+	}
+	assert.Equal(t, []int{3, 4, 0, 1, 2}, order)
+
+	q.close()
+	assert.Nil(t, pollWait(q, all))
+}
+
+func TestPieceQueueResetKeepsPriority(t *testing.T) {
+	q := newPieceQueue()
+	// 下载开始之前设置的优先级，在重新放入task之后仍然有效
+	q.prioritize(2, 4)
+	q.reset()
+	for i := 0; i < 5; i++ {
+		q.push(&pieceTask{index: i})
+	}
+	all := func(int) bool { return true }
+	var order []int
+	for i := 0; i < 5; i++ {
+		order = append(order, pollWait(q, all).index)
+	}
+	assert.Equal(t, []int{2, 3, 0, 1, 4}, order)
+}
+
+func TestPieceQueuePoll(t *testing.T) {
+	q := newPieceQueue()
+	even := func(index int) bool { return index%2 == 0 }
+	q.push(&pieceTask{index: 1})
+	task, changed, closed := q.poll(even)
+	assert.Nil(t, task)
+	assert.False(t, closed)
+
+	// 放入新的task时唤醒等待者
+	q.push(&pieceTask{index: 2})
+	<-changed
+	task, _, _ = q.poll(even)
+	assert.Equal(t, 2, task.index)
+
+	_, changed, _ = q.poll(even)
+	q.close()
+	<-changed
+	_, _, closed = q.poll(even)
+	assert.True(t, closed)
+}
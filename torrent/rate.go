@@ -0,0 +1,97 @@
+package torrent
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// 进程全局的限速，对所有任务的所有连接生效
+var (
+	DownloadLimit = NewLimiter(0)
+	UploadLimit   = NewLimiter(0)
+)
+
+// 等待时最长的一次睡眠，醒来后重新检查速率，使SetLimit可以在运行时生效
+const maxLimiterSleep = 100 * time.Millisecond
+
+// 令牌桶限速器，速率的单位为byte/s，为0时不限速
+// 允许透支：桶中的令牌不为负时可以一次取走任意多个，之后的请求要等透支的部分补回来
+// 这样一个比桶还大的piece消息也能通过，平均速率仍然受限
+type Limiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func NewLimiter(bytesPerSec int) *Limiter {
+	l := &Limiter{}
+	l.SetLimit(bytesPerSec)
+	return l
+}
+
+// 修改速率，可以在运行时调用
+func (l *Limiter) SetLimit(bytesPerSec int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = float64(bytesPerSec)
+	// 桶的容量为一秒的流量
+	l.tokens = l.rate
+	l.last = time.Now()
+}
+
+func (l *Limiter) Limit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int(l.rate)
+}
+
+// 取走n个令牌，令牌不够时阻塞，ctx取消时返回错误
+func (l *Limiter) WaitN(ctx context.Context, n int) error {
+	for {
+		l.mu.Lock()
+		if l.rate <= 0 {
+			l.mu.Unlock()
+			return nil
+		}
+		now := time.Now()
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.rate {
+			l.tokens = l.rate
+		}
+		l.last = now
+		if l.tokens >= 0 {
+			l.tokens -= float64(n)
+			l.mu.Unlock()
+			return nil
+		}
+		wait := time.Duration(-l.tokens / l.rate * float64(time.Second))
+		l.mu.Unlock()
+
+		if wait > maxLimiterSleep {
+			wait = maxLimiterSleep
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// 依次等待所有的限速器，nil表示不限速
+func waitLimiters(ctx context.Context, limiters []*Limiter, n int) error {
+	for _, l := range limiters {
+		if l == nil {
+			continue
+		}
+		err := l.WaitN(ctx, n)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package torrent
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimiterWait(t *testing.T) {
+	l := NewLimiter(1000)
+	start := time.Now()
+	// 一秒的令牌加上透支的部分可以立即取走，第四次要等透支的500个补回来
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, nil, l.WaitN(context.Background(), 500))
+	}
+	elapsed := time.Since(start)
+	assert.Greater(t, elapsed, 400*time.Millisecond)
+	assert.Less(t, elapsed, time.Second)
+
+	// 运行时取消限速，等待中的请求立即返回
+	l.WaitN(context.Background(), 5000)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		l.SetLimit(0)
+	}()
+	start = time.Now()
+	assert.Equal(t, nil, l.WaitN(context.Background(), 500))
+	assert.Less(t, time.Since(start), time.Second)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	l.SetLimit(1)
+	l.WaitN(ctx, 10)
+	assert.ErrorIs(t, l.WaitN(ctx, 10), context.Canceled)
+}
+
+func TestLimiterOnlyPieces(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	l := NewLimiter(1)
+	l.WaitN(context.Background(), 1000)
+	c := &PeerConn{Conn: b, down: []*Limiter{l}}
+
+	// 协议消息不受限速影响
+	go (&PeerConn{Conn: a}).WriteMsg(&PeerMsg{MsgHave, []byte{0, 0, 0, 1}})
+	b.SetDeadline(time.Now().Add(time.Second))
+	msg, err := c.ReadMsg()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, MsgHave, msg.Id)
+
+	// piece消息要等待令牌，超时之前读不到
+	go (&PeerConn{Conn: a}).WriteMsg(&PeerMsg{MsgPiece, make([]byte, 8+16)})
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	c.ctx = ctx
+	_, err = c.ReadMsg()
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
@@ -0,0 +1,191 @@
+package torrent
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const serverPrefix = "/torrents/"
+
+// 通过http提供正在下载的文件，路径为 /torrents/<infohash>/<path>
+// 支持Range请求，请求的数据还没有下载完时会阻塞，并优先下载这些piece
+type Server struct {
+	mu    sync.RWMutex
+	tasks map[string]*TorrentTask
+}
+
+func NewServer() *Server {
+	return &Server{tasks: make(map[string]*TorrentTask)}
+}
+
+func (s *Server) Add(task *TorrentTask) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tasks[hex.EncodeToString(task.InfoSHA[:])] = task
+}
+
+func (s *Server) Remove(infoSHA [SHALEN]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.tasks, hex.EncodeToString(infoSHA[:]))
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// 路径格式为 <infohash>/<path>
+	rest, ok := strings.CutPrefix(r.URL.Path, serverPrefix)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	hash, name, ok := strings.Cut(rest, "/")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	s.mu.RLock()
+	task := s.tasks[strings.ToLower(hash)]
+	s.mu.RUnlock()
+	// 目前只支持单文件的种子，path就是文件名，FileName中的目录只是保存的位置，不出现在url中
+	if task == nil || name != filepath.Base(task.FileName) {
+		http.NotFound(w, r)
+		return
+	}
+
+	// 没有Content-Type时ServeContent会读取文件开头来猜测类型，这样会阻塞在第一个piece上
+	if w.Header().Get("Content-Type") == "" {
+		ctype := mime.TypeByExtension(path.Ext(name))
+		if ctype == "" {
+			ctype = "application/octet-stream"
+		}
+		w.Header().Set("Content-Type", ctype)
+	}
+
+	// 提前把请求范围内的piece移到队列最前面，而不是读到时才一块一块地调整
+	if begin, end, ok := parseRange(r.Header.Get("Range"), int64(task.FileLen)); ok {
+		task.prioritize(int(begin/int64(task.PieceLen)), int((end-1)/int64(task.PieceLen))+1)
+	}
+
+	reader := &pieceReader{task: task, ctx: r.Context()}
+	defer reader.Close()
+	http.ServeContent(w, r, name, time.Time{}, reader)
+}
+
+// 解析Range头中的第一段范围，返回[begin, end)，只用于调整下载顺序，真正的Range处理交给ServeContent
+func parseRange(header string, size int64) (begin, end int64, ok bool) {
+	spec, found := strings.CutPrefix(header, "bytes=")
+	if !found || size <= 0 {
+		return 0, 0, false
+	}
+	spec, _, _ = strings.Cut(spec, ",")
+	first, last, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return 0, 0, false
+	}
+
+	if first == "" {
+		// bytes=-n 表示最后n个byte
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, false
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, size, true
+	}
+
+	begin, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || begin < 0 || begin >= size {
+		return 0, 0, false
+	}
+	end = size
+	if last != "" {
+		e, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || e < begin {
+			return 0, 0, false
+		}
+		if e+1 < size {
+			end = e + 1
+		}
+	}
+	return begin, end, true
+}
+
+// 按piece读取任务文件的io.ReadSeeker，读到还没有校验通过的piece时会阻塞
+type pieceReader struct {
+	task *TorrentTask
+	ctx  context.Context
+	off  int64
+	file *os.File
+}
+
+func (r *pieceReader) Read(p []byte) (int, error) {
+	t := r.task
+	if r.off >= int64(t.FileLen) {
+		return 0, io.EOF
+	}
+
+	// 每次最多读到当前piece的结尾，这样已经下载好的部分可以先发出去
+	index := int(r.off / int64(t.PieceLen))
+	_, end := t.getPieceBounds(index)
+	if remain := int64(end) - r.off; int64(len(p)) > remain {
+		p = p[:remain]
+	}
+
+	err := t.waitPiece(r.ctx, index)
+	if err != nil {
+		return 0, err
+	}
+
+	// piece校验通过时文件已经由Download创建好了
+	if r.file == nil {
+		r.file, err = os.Open(t.FileName)
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.file.ReadAt(p, r.off)
+	r.off += int64(n)
+	return n, err
+}
+
+func (r *pieceReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.off
+	case io.SeekEnd:
+		offset += int64(r.task.FileLen)
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.off = offset
+	return offset, nil
+}
+
+func (r *pieceReader) Close() error {
+	if r.file == nil {
+		return nil
+	}
+	return r.file.Close()
+}
@@ -0,0 +1,70 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerRange(t *testing.T) {
+	// url中只有文件名，不包含保存的目录
+	fileName := filepath.Join(t.TempDir(), "file.bin")
+	data := []byte("0123456789")
+	os.WriteFile(fileName, data, 0644)
+
+	task := &TorrentTask{
+		InfoSHA:  sha1.Sum(data),
+		FileName: fileName,
+		FileLen:  len(data),
+		PieceLen: 4,
+		PieceSHA: make([][SHALEN]byte, 3),
+	}
+	task.init()
+	close(task.done[0])
+
+	srv := NewServer()
+	srv.Add(task)
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	url := ts.URL + "/torrents/" + hexHash(task.InfoSHA) + "/file.bin"
+
+	// 已经完成的piece可以直接读取
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	req.Header.Set("Range", "bytes=1-2")
+	resp, err := http.DefaultClient.Do(req)
+	assert.Equal(t, nil, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, "12", string(body))
+
+	// 还没有完成的piece会阻塞到其校验通过
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(task.done[1])
+	}()
+	req, _ = http.NewRequest(http.MethodGet, url, nil)
+	req.Header.Set("Range", "bytes=3-6")
+	resp, err = http.DefaultClient.Do(req)
+	assert.Equal(t, nil, err)
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "3456", string(body))
+
+	resp, err = http.Get(ts.URL + "/torrents/" + hexHash(task.InfoSHA) + "/other.bin")
+	assert.Equal(t, nil, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func hexHash(sha [SHALEN]byte) string {
+	return hex.EncodeToString(sha[:])
+}
@@ -0,0 +1,511 @@
+package torrent
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	ErrSessionClosed   = errors.New("session closed")
+	ErrTorrentExists   = errors.New("torrent already exists")
+	ErrTorrentNotFound = errors.New("torrent not found")
+)
+
+type TorrentState uint8
+
+const (
+	StateDownloading TorrentState = iota
+	StatePaused
+	StateComplete
+	StateFailed
+)
+
+func (s TorrentState) String() string {
+	switch s {
+	case StateDownloading:
+		return "downloading"
+	case StatePaused:
+		return "paused"
+	case StateComplete:
+		return "complete"
+	case StateFailed:
+		return "failed"
+	}
+	return "unknown"
+}
+
+// Session中某个任务当前的状态
+type TorrentStatus struct {
+	InfoSHA [SHALEN]byte
+	Name    string
+	State   TorrentState
+	Done    int   // 已经完成的piece数量
+	Total   int   // piece的总数
+	Err     error // 最近一次下载退出的原因
+}
+
+type SessionConfig struct {
+	Port        int           // 监听的端口，为0时由系统分配
+	MaxConns    int           // 所有任务加起来的最大连接数，为0时不限制
+	MaxPeers    int           // 每个任务的最大连接数，任务没有设置MaxPeers时使用，为0时使用DefaultMaxPeers
+	DiskWorkers int           // 写文件的go routine数量，为0时使用defaultDiskWorkers
+	PeerGrace   time.Duration // 任务没有peer时等待对方发起连接的时间，为0时使用defaultPeerGrace
+	DownRate    int           // 所有任务加起来的下载速率，单位为byte/s，为0时不限速
+	UpRate      int           // 所有任务加起来的上传速率
+
+	// Session的peer id前缀，为空时使用DefaultPeerIDPrefix
+	PeerIDPrefix string
+
+	// 主动连接和接收连接时的加密策略，对Session中的所有任务生效
+	Encryption EncryptionPolicy
+	// 连接各个阶段的超时，任务没有设置Timeouts时使用这里的值
+	Timeouts Timeouts
+}
+
+const (
+	defaultDiskWorkers = 4
+	defaultPeerGrace   = 30 * time.Second
+	maxPendingAccepts  = 32 // 同时进行握手的对方发起的连接数
+)
+
+// 同时运行多个任务，所有任务共享监听端口、PeerId、连接数上限、限速和写文件的go routine
+type Session struct {
+	PeerId [IDLEN]byte
+
+	// Session中所有任务共享的限速，可以在运行时通过SetLimit修改
+	DownloadLimit *Limiter
+	UploadLimit   *Limiter
+
+	port       int
+	grace      time.Duration
+	encryption EncryptionPolicy
+	timeouts   Timeouts
+	maxPeers   int
+	listener   net.Listener
+	utp        *utpSocket
+	conns      chan struct{}
+	pending    chan struct{}
+	disk       *diskPool
+	bans       *banList
+
+	mu       sync.Mutex
+	torrents map[[SHALEN]byte]*sessionTorrent
+	closed   bool
+	running  sync.WaitGroup // 所有正在运行的下载，包括正在Remove的
+}
+
+type sessionTorrent struct {
+	task   *TorrentTask
+	state  TorrentState
+	err    error
+	cancel context.CancelFunc
+	done   chan struct{} // 当前这次下载退出后关闭
+}
+
+func NewSession(cfg SessionConfig) (*Session, error) {
+	peerId, err := NewPeerID(cfg.PeerIDPrefix)
+	if err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen("tcp", ":"+strconv.Itoa(cfg.Port))
+	if err != nil {
+		return nil, err
+	}
+	// uTP使用和TCP相同的端口号
+	port := ln.Addr().(*net.TCPAddr).Port
+	utp, err := listenUTP(":" + strconv.Itoa(port))
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+
+	workers := cfg.DiskWorkers
+	if workers <= 0 {
+		workers = defaultDiskWorkers
+	}
+	grace := cfg.PeerGrace
+	if grace <= 0 {
+		grace = defaultPeerGrace
+	}
+	s := &Session{
+		PeerId:        peerId,
+		DownloadLimit: NewLimiter(cfg.DownRate),
+		UploadLimit:   NewLimiter(cfg.UpRate),
+		port:          port,
+		grace:         grace,
+		encryption:    cfg.Encryption,
+		timeouts:      cfg.Timeouts,
+		maxPeers:      cfg.MaxPeers,
+		listener:      ln,
+		utp:           utp,
+		pending:       make(chan struct{}, maxPendingAccepts),
+		disk:          newDiskPool(workers),
+		bans:          newBanList(),
+		torrents:      make(map[[SHALEN]byte]*sessionTorrent),
+	}
+	if cfg.MaxConns > 0 {
+		s.conns = make(chan struct{}, cfg.MaxConns)
+	}
+
+	go s.acceptLoop(s.listener)
+	go s.acceptLoop(s.utp)
+	return s, nil
+}
+
+// 实际监听的端口，TCP和uTP使用同一个端口号
+func (s *Session) Port() int {
+	return s.port
+}
+
+// 添加任务并立即开始下载，任务的PeerId和Encryption会被替换为Session的设置
+func (s *Session) Add(task *TorrentTask) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrSessionClosed
+	}
+	if _, ok := s.torrents[task.InfoSHA]; ok {
+		return ErrTorrentExists
+	}
+
+	task.init()
+	task.PeerId = s.PeerId
+	task.port = s.port
+	task.conns = s.conns
+	task.disk = s.disk
+	task.bans = s.bans
+	task.utp = s.utp
+	task.grace = s.grace
+	task.down = s.DownloadLimit
+	task.up = s.UploadLimit
+	task.Encryption = s.encryption
+	if task.Timeouts == (Timeouts{}) {
+		task.Timeouts = s.timeouts
+	}
+	if task.MaxPeers <= 0 {
+		task.MaxPeers = s.maxPeers
+	}
+
+	st := &sessionTorrent{task: task}
+	s.torrents[task.InfoSHA] = st
+	s.start(st)
+	return nil
+}
+
+// 停止下载并从Session中移除，已经下载的文件不会删除
+func (s *Session) Remove(infoSHA [SHALEN]byte) error {
+	s.mu.Lock()
+	st, ok := s.torrents[infoSHA]
+	if !ok {
+		s.mu.Unlock()
+		return ErrTorrentNotFound
+	}
+	delete(s.torrents, infoSHA)
+	st.cancel()
+	done := st.done
+	s.mu.Unlock()
+
+	<-done
+	return nil
+}
+
+// 暂停下载，断开该任务的所有连接，之后可以通过Resume继续
+func (s *Session) Pause(infoSHA [SHALEN]byte) error {
+	s.mu.Lock()
+	st, ok := s.torrents[infoSHA]
+	if !ok {
+		s.mu.Unlock()
+		return ErrTorrentNotFound
+	}
+	if st.state == StateDownloading {
+		st.state = StatePaused
+		st.cancel()
+	}
+	done := st.done
+	s.mu.Unlock()
+
+	<-done
+	return nil
+}
+
+// 继续暂停或者失败的任务，已经校验通过的piece不会重新下载
+// 上一次下载还在退出时先等待其结束，否则同一个任务上会同时运行两个Download
+func (s *Session) Resume(infoSHA [SHALEN]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		if s.closed {
+			return ErrSessionClosed
+		}
+		st, ok := s.torrents[infoSHA]
+		if !ok {
+			return ErrTorrentNotFound
+		}
+		if st.state != StatePaused && st.state != StateFailed {
+			return nil
+		}
+		done := st.done
+		select {
+		case <-done:
+			s.start(st)
+			return nil
+		default:
+		}
+		// 等待时释放锁，退出的go routine需要持有锁更新状态
+		s.mu.Unlock()
+		<-done
+		s.mu.Lock()
+	}
+}
+
+// 等待任务当前这次下载退出，返回退出的原因，下载完成时为nil
+func (s *Session) Wait(infoSHA [SHALEN]byte) error {
+	s.mu.Lock()
+	st, ok := s.torrents[infoSHA]
+	if !ok {
+		s.mu.Unlock()
+		return ErrTorrentNotFound
+	}
+	done := st.done
+	s.mu.Unlock()
+
+	<-done
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return st.err
+}
+
+// 所有任务的状态，按名字排序
+func (s *Session) Torrents() []TorrentStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]TorrentStatus, 0, len(s.torrents))
+	for _, st := range s.torrents {
+		done := 0
+		for i := range st.task.PieceSHA {
+			if st.task.havePiece(i) {
+				done++
+			}
+		}
+		list = append(list, TorrentStatus{
+			InfoSHA: st.task.InfoSHA,
+			Name:    st.task.FileName,
+			State:   st.state,
+			Done:    done,
+			Total:   len(st.task.PieceSHA),
+			Err:     st.err,
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// 停止所有任务并关闭监听端口
+func (s *Session) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	err := s.listener.Close()
+	s.utp.Close()
+	for _, st := range s.torrents {
+		st.cancel()
+	}
+	s.mu.Unlock()
+
+	// 正在Remove的任务已经不在torrents中了，也要等它们退出后才能关闭disk pool
+	s.running.Wait()
+	s.disk.close()
+	return err
+}
+
+// 调用时需要持有s.mu
+func (s *Session) start(st *sessionTorrent) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	st.state = StateDownloading
+	st.err = nil
+	st.cancel = cancel
+	st.done = done
+
+	s.running.Add(1)
+	go func() {
+		defer s.running.Done()
+		err := s.run(ctx, st.task)
+		cancel()
+
+		s.mu.Lock()
+		// 只有当前这次下载才能更新状态
+		if st.done == done {
+			st.err = err
+			switch {
+			case err == nil:
+				st.state = StateComplete
+			case st.state == StatePaused:
+				// Pause取消的，保持暂停状态
+			default:
+				st.state = StateFailed
+			}
+		}
+		s.mu.Unlock()
+		close(done)
+	}()
+}
+
+func (s *Session) run(ctx context.Context, task *TorrentTask) error {
+	if len(task.PeerList) == 0 && task.Announce != "" {
+		// tracker失败时仍然可以等待对方通过监听端口发起连接
+		peers, err := task.FindPeers(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err == nil {
+			task.AddPeers(peers...)
+		}
+	}
+	return Download(ctx, task)
+}
+
+// 正在下载的任务，没有时返回nil
+func (s *Session) lookup(infoSHA [SHALEN]byte) *TorrentTask {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, ok := s.torrents[infoSHA]
+	if !ok || st.state != StateDownloading {
+		return nil
+	}
+	return st.task
+}
+
+// 所有正在下载的任务的info hash，用于匹配对方发起的连接
+func (s *Session) infoHashes() [][SHALEN]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var hashes [][SHALEN]byte
+	for h, st := range s.torrents {
+		if st.state == StateDownloading {
+			hashes = append(hashes, h)
+		}
+	}
+	return hashes
+}
+
+// 接收对方通过TCP或者uTP发起的连接
+func (s *Session) acceptLoop(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			// listener关闭时退出
+			return
+		}
+
+		// 正在握手的连接太多，或者连接数已满时，不做握手直接断开
+		select {
+		case s.pending <- struct{}{}:
+		default:
+			conn.Close()
+			continue
+		}
+		if !s.tryAcquireConn() {
+			<-s.pending
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer func() { <-s.pending }()
+			if !s.handleIncoming(conn) {
+				s.releaseConn()
+			}
+		}()
+	}
+}
+
+// 完成握手后把连接交给对应任务的Download，交出去之后由Download释放占用的连接数
+func (s *Session) handleIncoming(conn net.Conn) bool {
+	// 被ban的IP不做握手直接断开
+	if s.bans.isBanned(addrPeer(conn.RemoteAddr()).Ip.String()) {
+		conn.Close()
+		return false
+	}
+	c, err := acceptConn(conn, s.PeerId, s.encryption, s.timeouts, s.infoHashes)
+	if err != nil {
+		conn.Close()
+		return false
+	}
+
+	task := s.lookup(c.infoSHA)
+	if task == nil {
+		c.Close()
+		return false
+	}
+	select {
+	case task.incoming <- c:
+		return true
+	case <-time.After(time.Second):
+		// 任务已经暂停或者完成，不再接收新的连接
+		c.Close()
+		return false
+	}
+}
+
+func (s *Session) tryAcquireConn() bool {
+	if s.conns == nil {
+		return true
+	}
+	select {
+	case s.conns <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Session) releaseConn() {
+	if s.conns != nil {
+		<-s.conns
+	}
+}
+
+// 所有任务共享的写文件的go routine，限制同时进行的磁盘IO数量
+type diskPool struct {
+	jobs chan diskJob
+	wg   sync.WaitGroup
+}
+
+type diskJob struct {
+	fn  func() error
+	res chan error
+}
+
+func newDiskPool(workers int) *diskPool {
+	p := &diskPool{jobs: make(chan diskJob)}
+	for i := 0; i < workers; i++ {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for job := range p.jobs {
+				job.res <- job.fn()
+			}
+		}()
+	}
+	return p
+}
+
+// 交给pool中的go routine执行并等待结果
+func (p *diskPool) do(fn func() error) error {
+	res := make(chan error, 1)
+	p.jobs <- diskJob{fn, res}
+	return <-res
+}
+
+func (p *diskPool) close() {
+	close(p.jobs)
+	p.wg.Wait()
+}
@@ -0,0 +1,223 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 模拟拥有全部数据的peer，收到request后返回对应的数据
+func serveSeeder(conn net.Conn, data []byte, pieceLen int) {
+	c := &PeerConn{Conn: conn}
+	n := (len(data) + pieceLen - 1) / pieceLen
+	field := make(Bitfield, (n+7)/8)
+	for i := 0; i < n; i++ {
+		field.SetPiece(i)
+	}
+	c.WriteMsg(&PeerMsg{MsgBitfield, field})
+	for {
+		msg, err := c.ReadMsg()
+		if err != nil {
+			return
+		}
+		if msg == nil {
+			continue
+		}
+		switch msg.Id {
+		case MsgInterested:
+			c.WriteMsg(&PeerMsg{MsgUnchoke, nil})
+		case MsgRequest:
+			index := int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+			begin := int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+			length := int(binary.BigEndian.Uint32(msg.Payload[8:12]))
+			payload := make([]byte, 8+length)
+			copy(payload, msg.Payload[:8])
+			copy(payload[8:], data[index*pieceLen+begin:])
+			c.WriteMsg(&PeerMsg{MsgPiece, payload})
+		}
+	}
+}
+
+func newSessionTask(t *testing.T, data []byte, pieceLen int, peers []PeerInfo) *TorrentTask {
+	var shas [][SHALEN]byte
+	for i := 0; i < len(data); i += pieceLen {
+		end := i + pieceLen
+		if end > len(data) {
+			end = len(data)
+		}
+		shas = append(shas, sha1.Sum(data[i:end]))
+	}
+	return &TorrentTask{
+		PeerList: peers,
+		InfoSHA:  sha1.Sum(data),
+		FileName: filepath.Join(t.TempDir(), "file.bin"),
+		FileLen:  len(data),
+		PieceLen: pieceLen,
+		PieceSHA: shas,
+	}
+}
+
+func TestSessionIncoming(t *testing.T) {
+	s, err := NewSession(SessionConfig{MaxConns: 4})
+	assert.Equal(t, nil, err)
+	defer s.Close()
+
+	data := []byte("incoming peers share the listen port")
+	// 没有任何peer，只能等待对方主动连接
+	task := newSessionTask(t, data, 8, nil)
+	assert.Equal(t, nil, s.Add(task))
+	assert.Equal(t, ErrTorrentExists, s.Add(task))
+
+	// 对方主动连接Session的端口
+	conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(s.Port()))
+	assert.Equal(t, nil, err)
+	defer conn.Close()
+	var peerId [IDLEN]byte
+	WriteHandShake(conn, NewHandShakeMsg(task.InfoSHA, peerId))
+	hs, err := ReadHandshake(conn)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, s.PeerId, hs.PeerId)
+	go serveSeeder(conn, data, 8)
+
+	assert.Equal(t, nil, s.Wait(task.InfoSHA))
+	got, _ := os.ReadFile(task.FileName)
+	assert.Equal(t, data, got)
+
+	list := s.Torrents()
+	assert.Equal(t, 1, len(list))
+	assert.Equal(t, StateComplete, list[0].State)
+	assert.Equal(t, list[0].Total, list[0].Done)
+}
+
+func TestSessionPauseResume(t *testing.T) {
+	s, err := NewSession(SessionConfig{})
+	assert.Equal(t, nil, err)
+	defer s.Close()
+
+	task := newSessionTask(t, []byte("0123456789"), 4, nil)
+	assert.Equal(t, nil, s.Add(task))
+	time.Sleep(50 * time.Millisecond)
+
+	assert.Equal(t, nil, s.Pause(task.InfoSHA))
+	assert.Equal(t, StatePaused, s.Torrents()[0].State)
+
+	assert.Equal(t, nil, s.Resume(task.InfoSHA))
+	assert.Equal(t, StateDownloading, s.Torrents()[0].State)
+
+	assert.Equal(t, nil, s.Remove(task.InfoSHA))
+	assert.Equal(t, 0, len(s.Torrents()))
+	assert.Equal(t, ErrTorrentNotFound, s.Pause(task.InfoSHA))
+}
+
+func TestSessionPauseResumeConcurrent(t *testing.T) {
+	s, err := NewSession(SessionConfig{})
+	assert.Equal(t, nil, err)
+	defer s.Close()
+
+	task := newSessionTask(t, []byte("0123456789"), 4, nil)
+	assert.Equal(t, nil, s.Add(task))
+	for i := 0; i < 20; i++ {
+		// Resume可能发生在Pause等待上一次下载退出的过程中
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			s.Pause(task.InfoSHA)
+		}()
+		go func() {
+			defer wg.Done()
+			s.Resume(task.InfoSHA)
+		}()
+		wg.Wait()
+
+		// Pause在Resume之后完成时是暂停状态，否则新的下载正在运行，旧的下载退出时不能覆盖其状态
+		st := s.Torrents()[0]
+		if st.State == StatePaused {
+			assert.Equal(t, nil, s.Resume(task.InfoSHA))
+			continue
+		}
+		assert.Equal(t, StateDownloading, st.State)
+		assert.Equal(t, nil, st.Err)
+	}
+	assert.Equal(t, nil, s.Pause(task.InfoSHA))
+	assert.Equal(t, StatePaused, s.Torrents()[0].State)
+}
+
+func TestSessionPeerID(t *testing.T) {
+	s, err := NewSession(SessionConfig{})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, DefaultPeerIDPrefix, string(s.PeerId[:len(DefaultPeerIDPrefix)]))
+	s.Close()
+
+	s, err = NewSession(SessionConfig{PeerIDPrefix: "-XX0100-"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "-XX0100-", string(s.PeerId[:8]))
+	s.Close()
+
+	_, err = NewSession(SessionConfig{PeerIDPrefix: "-this-prefix-is-too-long-"})
+	assert.NotEqual(t, nil, err)
+}
+
+func TestSessionNoPeersGrace(t *testing.T) {
+	s, err := NewSession(SessionConfig{PeerGrace: 100 * time.Millisecond})
+	assert.Equal(t, nil, err)
+	defer s.Close()
+
+	task := newSessionTask(t, []byte("0123456789"), 4, nil)
+	assert.Equal(t, nil, s.Add(task))
+	assert.ErrorIs(t, s.Wait(task.InfoSHA), ErrNoPeers)
+	assert.Equal(t, StateFailed, s.Torrents()[0].State)
+}
+
+func TestSessionRemoveClose(t *testing.T) {
+	s, err := NewSession(SessionConfig{})
+	assert.Equal(t, nil, err)
+
+	task := newSessionTask(t, []byte("0123456789"), 4, nil)
+	assert.Equal(t, nil, s.Add(task))
+	// Remove和Close同时进行时，Close要等正在移除的任务退出
+	go s.Remove(task.InfoSHA)
+	assert.Equal(t, nil, s.Close())
+	assert.Equal(t, ErrSessionClosed, s.Add(task))
+}
+
+func TestSessionIncomingEncrypted(t *testing.T) {
+	s, err := NewSession(SessionConfig{Encryption: EncryptionRequire})
+	assert.Equal(t, nil, err)
+	defer s.Close()
+
+	data := []byte("encrypted incoming peer")
+	task := newSessionTask(t, data, 8, nil)
+	assert.Equal(t, nil, s.Add(task))
+	assert.Equal(t, EncryptionRequire, task.Encryption)
+
+	// 明文握手被拒绝
+	plain, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(s.Port()))
+	assert.Equal(t, nil, err)
+	defer plain.Close()
+	var peerId [IDLEN]byte
+	WriteHandShake(plain, NewHandShakeMsg(task.InfoSHA, peerId))
+	_, err = ReadHandshake(plain)
+	assert.NotEqual(t, nil, err)
+
+	raw, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(s.Port()))
+	assert.Equal(t, nil, err)
+	defer raw.Close()
+	conn, err := mseInitiate(raw, task.InfoSHA, cryptoRC4)
+	assert.Equal(t, nil, err)
+	_, err = handshake(conn, task.InfoSHA, peerId)
+	assert.Equal(t, nil, err)
+	go serveSeeder(conn, data, 8)
+
+	assert.Equal(t, nil, s.Wait(task.InfoSHA))
+	got, _ := os.ReadFile(task.FileName)
+	assert.Equal(t, data, got)
+}
@@ -10,16 +10,49 @@ import (
 )
 
 // 原始文件中该key有空格，因此不能依靠将名字转为小写来定位到key，只能手动打tag
+// info hash是将rawInfo重新编码之后计算的，可选的key没有出现时也不能写入，否则hash和其他客户端不同
 type rawInfo struct {
-	Length      int    `bencode:"length"`
-	Name        string `bencode:"name"`
-	PieceLength int    `bencode:"piece length"`
-	Pieces      string `bencode:"pieces"`
+	Length      int         `bencode:"length"`
+	Name        string      `bencode:"name,required"`
+	PieceLength int         `bencode:"piece length,required"`
+	Pieces      pieceHashes `bencode:"pieces,required"`
+	Private     int         `bencode:"private,omitempty"`
+}
+
+// info中的pieces是所有piece的SHA拼接在一起的字符串，直接解码为数组
+type pieceHashes [][SHALEN]byte
+
+func (h pieceHashes) MarshalBencode() ([]byte, error) {
+	bys := make([]byte, 0, len(h)*SHALEN)
+	for _, sha := range h {
+		bys = append(bys, sha[:]...)
+	}
+	buf := new(bytes.Buffer)
+	if _, err := bencode.EncodeString(buf, string(bys)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (h *pieceHashes) UnmarshalBencode(b []byte) error {
+	str, err := bencode.DecodeString(bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	if len(str)%SHALEN != 0 {
+		return fmt.Errorf("malformed pieces: length %d", len(str))
+	}
+	hashes := make(pieceHashes, len(str)/SHALEN)
+	for i := range hashes {
+		copy(hashes[i][:], str[i*SHALEN:(i+1)*SHALEN])
+	}
+	*h = hashes
+	return nil
 }
 
 type rawFile struct {
 	Announce string  `bencode:"announce"`
-	Info     rawInfo `bencode:"info"`
+	Info     rawInfo `bencode:"info,required"`
 }
 
 // SHA值放入数组中，方便使用
@@ -41,8 +74,7 @@ func ParseFile(r io.Reader) (*TorrentFile, error) {
 	raw := new(rawFile)
 	err := bencode.Unmarshal(r, raw)
 	if err != nil {
-		fmt.Println("Fail to parse torrent file")
-		return nil, err
+		return nil, fmt.Errorf("fail to parse torrent file: %w", err)
 	}
 
 	ret := new(TorrentFile)
@@ -53,23 +85,12 @@ func ParseFile(r io.Reader) (*TorrentFile, error) {
 
 	// 计算SHA
 	buf := new(bytes.Buffer)
-	wlen := bencode.Marshal(buf, raw.Info)
-
-	if wlen == 0 {
-		fmt.Println("raw file info error")
+	_, err = bencode.Marshal(buf, raw.Info)
+	if err != nil {
+		return nil, fmt.Errorf("raw file info error: %w", err)
 	}
 
 	ret.InfoSHA = sha1.Sum(buf.Bytes())
-
-	// 计算每一块的SHA
-	// 这里做了一个类型转换，将raw.Info.Pieces转换为byte slice
-	// raw.Info.Pieces是一个string，转成byte slice方便处理
-	bys := []byte(raw.Info.Pieces)
-	cnt := len(bys) / SHALEN
-	hashes := make([][SHALEN]byte, cnt)
-	for i := 0; i < cnt; i++ {
-		copy(hashes[i][:], bys[i*SHALEN:(i+1)*SHALEN])
-	}
-	ret.PieceSHA = hashes
+	ret.PieceSHA = raw.Info.Pieces
 	return ret, nil
 }
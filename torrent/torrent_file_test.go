@@ -2,9 +2,13 @@ package torrent
 
 import (
 	"bufio"
+	"crypto/sha1"
+	"errors"
 	"os"
+	"strings"
 	"testing"
 
+	"github.com/patrickhao/go-torrent/bencode"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -22,3 +26,18 @@ func TestParseFile(t *testing.T) {
 		0xce, 0xb6, 0xfb, 0x58, 0x61, 0x7e, 0x69, 0x95, 0xa7, 0xed, 0xdb}
 	assert.Equal(t, expectHASH, tf.InfoSHA)
 }
+
+func TestParseFilePrivate(t *testing.T) {
+	info := "d6:lengthi3e4:name1:a12:piece lengthi16e6:pieces20:" + strings.Repeat("x", SHALEN) + "7:privatei1ee"
+	tf, err := ParseFile(strings.NewReader("d8:announce3:url4:info" + info + "e"))
+	assert.Equal(t, nil, err)
+	// 可选的private也参与info hash的计算
+	assert.Equal(t, sha1.Sum([]byte(info)), tf.InfoSHA)
+	assert.Equal(t, 1, len(tf.PieceSHA))
+
+	// 缺少必须的key
+	_, err = ParseFile(strings.NewReader("d8:announce3:urle"))
+	assert.True(t, errors.Is(err, bencode.ErrRequired))
+	_, err = ParseFile(strings.NewReader("d8:announce3:url4:infod6:lengthi3e4:name1:aee"))
+	assert.True(t, errors.Is(err, bencode.ErrRequired))
+}
@@ -1,6 +1,8 @@
 package torrent
 
 import (
+	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"net"
@@ -27,37 +29,69 @@ type PeerInfo struct {
 }
 
 type TrackerResp struct {
-	Interval int    `bencode:"interval"`
-	Peers    string `bencode:"peers"`
+	Interval int          `bencode:"interval"`
+	Peers    CompactPeers `bencode:"peers"`
+}
+
+// tracker返回的compact格式的peer列表，每个peer占PeerLen个字节
+type CompactPeers []PeerInfo
+
+func (c CompactPeers) MarshalBencode() ([]byte, error) {
+	bys := make([]byte, len(c)*PeerLen)
+	for i, p := range c {
+		ip := p.Ip.To4()
+		if ip == nil {
+			return nil, fmt.Errorf("not an ipv4 peer: %v", p.Ip)
+		}
+		offset := i * PeerLen
+		copy(bys[offset:], ip)
+		binary.BigEndian.PutUint16(bys[offset+IpLen:], p.Port)
+	}
+	buf := new(bytes.Buffer)
+	if _, err := bencode.EncodeString(buf, string(bys)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *CompactPeers) UnmarshalBencode(b []byte) error {
+	str, err := bencode.DecodeString(bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	infos, err := buildPeerInfo([]byte(str))
+	if err != nil {
+		return err
+	}
+	*c = infos
+	return nil
 }
 
 // 打包http请求
-func buildUrl(tf *TorrentFile, peerId [IDLEN]byte) (string, error) {
-	base, err := url.Parse(tf.Announce)
+func buildUrl(announce string, infoSHA [SHALEN]byte, peerId [IDLEN]byte, port int, left int) (string, error) {
+	base, err := url.Parse(announce)
 	if err != nil {
-		fmt.Println("Announce Error: " + tf.Announce)
-		return "", err
+		return "", fmt.Errorf("announce error: %s: %w", announce, err)
 	}
 
 	params := url.Values{
-		"info_hash":  []string{string(tf.InfoSHA[:])},
+		"info_hash":  []string{string(infoSHA[:])},
 		"peer_id":    []string{string(peerId[:])}, // 自己下载器的标识
-		"port":       []string{strconv.Itoa(PeerPort)},
+		"port":       []string{strconv.Itoa(port)},
 		"uploaded":   []string{"0"},
 		"downloaded": []string{"0"},
 		"compact":    []string{"1"},
-		"left":       []string{strconv.Itoa(tf.FileLen)},
+		"left":       []string{strconv.Itoa(left)},
 	}
 
 	base.RawQuery = params.Encode()
 	return base.String(), nil
 }
 
-func buildPeerInfo(peers []byte) []PeerInfo {
+func buildPeerInfo(peers []byte) ([]PeerInfo, error) {
 	num := len(peers) / PeerLen
 	if len(peers)%PeerLen != 0 {
-		fmt.Println("Received malformed peers")
-		return nil
+		return nil, fmt.Errorf("received malformed peers")
 	}
 
 	infos := make([]PeerInfo, num)
@@ -68,32 +102,48 @@ func buildPeerInfo(peers []byte) []PeerInfo {
 		infos[i].Port = binary.BigEndian.Uint16(peers[offset+IpLen : offset+PeerLen])
 	}
 
-	return infos
+	return infos, nil
 }
 
-// 这里的peerId是本地客户端的标识，包含一些客户端的信息，这里因为是一个toy，使用的是随机生成的
-func FindPeers(tf *TorrentFile, peerId [IDLEN]byte) []PeerInfo {
-	url, err := buildUrl(tf, peerId)
+func announce(ctx context.Context, announce string, infoSHA [SHALEN]byte, peerId [IDLEN]byte, port int, left int) ([]PeerInfo, error) {
+	url, err := buildUrl(announce, infoSHA, peerId, port, left)
 	if err != nil {
-		fmt.Println("Build Tracker Url Error: " + err.Error())
-		return nil
+		return nil, err
 	}
 
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
 	cli := &http.Client{Timeout: 15 * time.Second}
 	// 发的是http Get请求
-	resp, err := cli.Get(url)
+	resp, err := cli.Do(req)
 	if err != nil {
-		fmt.Println("Fail to Connect to Tracker: " + err.Error())
-		return nil
+		return nil, fmt.Errorf("fail to connect to tracker: %w", err)
 	}
 	defer resp.Body.Close()
 
 	trackResp := new(TrackerResp)
 	err = bencode.Unmarshal(resp.Body, trackResp)
 	if err != nil {
-		fmt.Println("Tracker Response Error" + err.Error())
-		return nil
+		return nil, fmt.Errorf("tracker response error: %w", err)
 	}
 
-	return buildPeerInfo([]byte(trackResp.Peers))
+	return trackResp.Peers, nil
+}
+
+// 这里的peerId是本地客户端的标识，包含一些客户端的信息，这里因为是一个toy，使用的是随机生成的
+func FindPeers(tf *TorrentFile, peerId [IDLEN]byte) ([]PeerInfo, error) {
+	return announce(context.Background(), tf.Announce, tf.InfoSHA, peerId, PeerPort, tf.FileLen)
+}
+
+// 向任务的tracker请求peer，并将结果通过EventAnnounce通知Observer，ctx取消时立即返回
+func (t *TorrentTask) FindPeers(ctx context.Context) ([]PeerInfo, error) {
+	port := t.port
+	if port == 0 {
+		port = PeerPort
+	}
+	peers, err := announce(ctx, t.Announce, t.InfoSHA, t.PeerId, port, t.FileLen)
+	t.emit(Event{Type: EventAnnounce, Peers: len(peers), Err: err})
+	return peers, err
 }
@@ -2,10 +2,15 @@ package torrent
 
 import (
 	"bufio"
+	"bytes"
 	"crypto/rand"
 	"fmt"
+	"net"
 	"os"
 	"testing"
+
+	"github.com/patrickhao/go-torrent/bencode"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestTracker(t *testing.T) {
@@ -15,8 +20,33 @@ func TestTracker(t *testing.T) {
 	var peerId [IDLEN]byte
 	_, _ = rand.Read(peerId[:])
 
-	peers := FindPeers(tf, peerId)
+	peers, err := FindPeers(tf, peerId)
+	if err != nil {
+		t.Log("find peers err: " + err.Error())
+	}
 	for i, p := range peers {
 		fmt.Printf("Peer %d, Ip: %s, Port: %d\n", i, p.Ip, p.Port)
 	}
 }
+
+func TestCompactPeers(t *testing.T) {
+	str := "d8:intervali900e5:peers12:\x7f\x00\x00\x01\x1a\x0a\x0a\x00\x00\x02\x1a\x0be"
+	resp := new(TrackerResp)
+	err := bencode.Unmarshal(bytes.NewBufferString(str), resp)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 900, resp.Interval)
+	assert.Equal(t, 2, len(resp.Peers))
+	assert.True(t, net.IPv4(127, 0, 0, 1).Equal(resp.Peers[0].Ip))
+	assert.Equal(t, uint16(6666), resp.Peers[0].Port)
+	assert.True(t, net.IPv4(10, 0, 0, 2).Equal(resp.Peers[1].Ip))
+	assert.Equal(t, uint16(6667), resp.Peers[1].Port)
+
+	buf := new(bytes.Buffer)
+	_, err = bencode.Marshal(buf, resp)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, str, buf.String())
+
+	// 长度不是PeerLen的整数倍
+	err = bencode.Unmarshal(bytes.NewBufferString("d5:peers5:abcdee"), resp)
+	assert.NotEqual(t, nil, err)
+}
@@ -0,0 +1,891 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	mrand "math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// uTP(BEP 29)，在UDP上实现的可靠有序的字节流，对外表现为net.Conn，PeerConn不需要任何修改
+// 拥塞控制使用LEDBAT：根据对方测得的单向延迟调整窗口，排队延迟超过目标值时主动减小窗口，
+// 这样后台做种时不会塞满路由器的缓冲区，影响同一个网络中的交互流量
+
+const (
+	utpData  uint8 = 0
+	utpFin   uint8 = 1
+	utpState uint8 = 2
+	utpReset uint8 = 3
+	utpSyn   uint8 = 4
+
+	utpVersion   = 1
+	utpHeaderLen = 20
+	utpExtSack   = 1
+
+	utpMSS         = 1200    // 每个包中数据的最大长度，避免IP分片
+	utpRecvWindow  = 1 << 20 // 接收缓冲区的大小，同时也是发送窗口的上限
+	utpMaxOOO      = 512     // 最多缓存多少个乱序到达的包，也是selective ack能表示的范围
+	utpMinWindow   = utpMSS
+	utpInitWindow  = 4 * utpMSS
+	utpMaxGain     = 3000   // 延迟为0时每个RTT窗口增加的byte数
+	utpTarget      = 100000 // LEDBAT的目标排队延迟，单位为微秒
+	utpInitTimeout = time.Second
+	utpMinTimeout  = 500 * time.Millisecond
+	utpMaxTimeout  = 10 * time.Second
+	utpMaxRetries  = 8
+	utpTick        = 50 * time.Millisecond
+	utpDialTimeout = 2 * time.Second  // 超过这个时间没有回应就改用TCP
+	utpLinger      = 10 * time.Second // Close之后等待FIN被确认的最长时间
+	utpDelayWindow = time.Minute      // 基准延迟按分钟记录，取最近两分钟中的最小值
+	utpBacklog     = 32               // 还没有被Accept的连接数
+)
+
+var (
+	errUTPReset   = errors.New("utp: connection reset by peer")
+	errUTPTimeout = errors.New("utp: connection timed out")
+)
+
+type utpHeader struct {
+	typ       uint8
+	connId    uint16
+	timestamp uint32 // 发送时的时间，单位为微秒
+	timeDiff  uint32 // 发送方最近一次收到包时测得的延迟
+	wnd       uint32 // 发送方接收缓冲区的剩余空间
+	seq       uint16
+	ack       uint16
+	sack      []byte // selective ack的bitmask，第i位表示ack+2+i已经收到
+}
+
+func (h *utpHeader) marshal(payload []byte) []byte {
+	n := utpHeaderLen + len(payload)
+	if len(h.sack) > 0 {
+		n += 2 + len(h.sack)
+	}
+	buf := make([]byte, n)
+	buf[0] = h.typ<<4 | utpVersion
+	binary.BigEndian.PutUint16(buf[2:4], h.connId)
+	binary.BigEndian.PutUint32(buf[4:8], h.timestamp)
+	binary.BigEndian.PutUint32(buf[8:12], h.timeDiff)
+	binary.BigEndian.PutUint32(buf[12:16], h.wnd)
+	binary.BigEndian.PutUint16(buf[16:18], h.seq)
+	binary.BigEndian.PutUint16(buf[18:20], h.ack)
+
+	cur := utpHeaderLen
+	if len(h.sack) > 0 {
+		buf[1] = utpExtSack
+		buf[cur] = 0 // 没有下一个extension
+		buf[cur+1] = byte(len(h.sack))
+		cur += 2 + copy(buf[cur+2:], h.sack)
+	}
+	copy(buf[cur:], payload)
+	return buf
+}
+
+func parseUTPPacket(b []byte) (*utpHeader, []byte, error) {
+	if len(b) < utpHeaderLen {
+		return nil, nil, fmt.Errorf("utp packet too short: %d", len(b))
+	}
+	if b[0]&0x0f != utpVersion || b[0]>>4 > utpSyn {
+		return nil, nil, fmt.Errorf("not a utp packet")
+	}
+	h := &utpHeader{
+		typ:       b[0] >> 4,
+		connId:    binary.BigEndian.Uint16(b[2:4]),
+		timestamp: binary.BigEndian.Uint32(b[4:8]),
+		timeDiff:  binary.BigEndian.Uint32(b[8:12]),
+		wnd:       binary.BigEndian.Uint32(b[12:16]),
+		seq:       binary.BigEndian.Uint16(b[16:18]),
+		ack:       binary.BigEndian.Uint16(b[18:20]),
+	}
+
+	// extension是一个链表，每一项为 下一项的类型, 长度, 数据
+	ext, cur := b[1], utpHeaderLen
+	for ext != 0 {
+		if len(b) < cur+2 || len(b) < cur+2+int(b[cur+1]) {
+			return nil, nil, fmt.Errorf("utp extension too short")
+		}
+		next, length := b[cur], int(b[cur+1])
+		if ext == utpExtSack {
+			h.sack = b[cur+2 : cur+2+length]
+		}
+		ext = next
+		cur += 2 + length
+	}
+	return h, b[cur:], nil
+}
+
+func utpNow() uint32 {
+	return uint32(time.Now().UnixMicro())
+}
+
+// 考虑回绕的序号比较
+func seqLess(a, b uint16) bool {
+	return int16(a-b) < 0
+}
+
+// 一个UDP端口上的所有uTP连接，根据对方的地址和connection id分发收到的包
+// 同时实现了net.Listener，Session用它在监听端口上接收uTP连接
+type utpSocket struct {
+	pc        net.PacketConn
+	connected bool // pc由DialUDP创建，只和一个地址通信
+	owned     bool // 只属于一个连接，连接结束时一起关闭
+
+	mu     sync.Mutex
+	conns  map[utpKey]*utpConn
+	accept chan *utpConn // 为nil时不接收对方发起的连接
+	closed bool
+	done   chan struct{}
+}
+
+type utpKey struct {
+	addr string
+	id   uint16 // 对方发来的包中的connection id，即我们的recvId
+}
+
+// 在addr上监听uTP连接
+func listenUTP(addr string) (*utpSocket, error) {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &utpSocket{
+		pc:     pc,
+		conns:  make(map[utpKey]*utpConn),
+		accept: make(chan *utpConn, utpBacklog),
+		done:   make(chan struct{}),
+	}
+	go s.readLoop()
+	return s, nil
+}
+
+// 发起uTP连接，sock为nil时单独创建一个连接对方的UDP socket，对方没有监听UDP端口时很快就能收到错误
+func dialUTP(ctx context.Context, addr string, sock *utpSocket) (net.Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if sock != nil {
+		return sock.dial(ctx, raddr)
+	}
+
+	pc, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return nil, err
+	}
+	s := &utpSocket{
+		pc:        pc,
+		connected: true,
+		owned:     true,
+		conns:     make(map[utpKey]*utpConn),
+		done:      make(chan struct{}),
+	}
+	go s.readLoop()
+	c, err := s.dial(ctx, raddr)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// 先尝试uTP，对方在utpDialTimeout内没有回应时使用TCP，两者都不超过timeout
+func dialTransport(ctx context.Context, addr string, sock *utpSocket, timeout time.Duration) (net.Conn, error) {
+	utpTimeout := utpDialTimeout
+	if timeout < utpTimeout {
+		utpTimeout = timeout
+	}
+	uctx, cancel := context.WithTimeout(ctx, utpTimeout)
+	conn, err := dialUTP(uctx, addr, sock)
+	cancel()
+	if err == nil {
+		return conn, nil
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	dialer := net.Dialer{Timeout: timeout}
+	return dialer.DialContext(ctx, "tcp", addr)
+}
+
+func (s *utpSocket) Accept() (net.Conn, error) {
+	select {
+	case c := <-s.accept:
+		return c, nil
+	case <-s.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (s *utpSocket) Addr() net.Addr {
+	return s.pc.LocalAddr()
+}
+
+func (s *utpSocket) Close() error {
+	return s.shutdown(net.ErrClosed)
+}
+
+// 关闭socket，所有连接都以err结束
+func (s *utpSocket) shutdown(err error) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	conns := s.conns
+	s.conns = make(map[utpKey]*utpConn)
+	s.mu.Unlock()
+
+	for _, c := range conns {
+		c.fail(err)
+	}
+	return s.pc.Close()
+}
+
+func (s *utpSocket) readLoop() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, addr, err := s.pc.ReadFrom(buf)
+		if err != nil {
+			// 连接了对方的socket收到ICMP错误，说明对方没有监听这个UDP端口
+			if s.connected || errors.Is(err, net.ErrClosed) {
+				s.shutdown(err)
+				return
+			}
+			continue
+		}
+		h, payload, err := parseUTPPacket(buf[:n])
+		if err != nil {
+			// 同一个端口上可能有其他协议的包
+			continue
+		}
+		s.dispatch(h, append([]byte(nil), payload...), addr)
+	}
+}
+
+func (s *utpSocket) dispatch(h *utpHeader, payload []byte, addr net.Addr) {
+	s.mu.Lock()
+	if h.typ != utpSyn {
+		c := s.conns[utpKey{addr.String(), h.connId}]
+		s.mu.Unlock()
+		if c != nil {
+			c.handle(h, payload)
+		}
+		return
+	}
+
+	// SYN中是对方的recvId，我们的recvId为它加1
+	key := utpKey{addr.String(), h.connId + 1}
+	c, ok := s.conns[key]
+	if !ok {
+		if s.accept == nil || s.closed || len(s.accept) == cap(s.accept) {
+			s.mu.Unlock()
+			return
+		}
+		c = newUTPConn(s, addr, h.connId+1, h.connId)
+		c.connected = true
+		c.seq = uint16(mrand.Uint32())
+		c.ack = h.seq
+		c.replyMicro = utpNow() - h.timestamp
+		c.peerWnd = int(h.wnd)
+		s.conns[key] = c
+		s.accept <- c
+		go c.tickLoop()
+	}
+	s.mu.Unlock()
+
+	// 重复的SYN说明对方没有收到回复，再回复一次
+	c.mu.Lock()
+	c.sendState()
+	c.mu.Unlock()
+}
+
+func (s *utpSocket) dial(ctx context.Context, addr net.Addr) (*utpConn, error) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil, net.ErrClosed
+	}
+	var id uint16
+	for {
+		id = uint16(mrand.Uint32())
+		if _, ok := s.conns[utpKey{addr.String(), id}]; !ok {
+			break
+		}
+	}
+	c := newUTPConn(s, addr, id, id+1)
+	s.conns[utpKey{addr.String(), id}] = c
+	s.mu.Unlock()
+	go c.tickLoop()
+
+	c.mu.Lock()
+	c.seq = 1
+	c.send(utpSyn, nil)
+	c.mu.Unlock()
+
+	for {
+		c.mu.Lock()
+		connected, err, changed := c.connected, c.err, c.changed
+		c.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		if connected {
+			return c, nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			c.fail(ctx.Err())
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (s *utpSocket) writeTo(b []byte, addr net.Addr) {
+	// 发送失败和丢包一样处理，由重传解决
+	if s.connected {
+		s.pc.(*net.UDPConn).Write(b)
+		return
+	}
+	s.pc.WriteTo(b, addr)
+}
+
+func (s *utpSocket) remove(c *utpConn) {
+	s.mu.Lock()
+	if s.conns[utpKey{c.addr.String(), c.recvId}] == c {
+		delete(s.conns, utpKey{c.addr.String(), c.recvId})
+	}
+	s.mu.Unlock()
+	if s.owned {
+		s.Close()
+	}
+}
+
+// 一个uTP连接
+type utpConn struct {
+	s      *utpSocket
+	addr   net.Addr
+	recvId uint16 // 对方发来的包中的connection id
+	sendId uint16 // 我们发出的包中的connection id
+
+	mu        sync.Mutex
+	changed   chan struct{} // 状态变化时关闭并替换，唤醒等待中的Read、Write和dial
+	connected bool
+	err       error // 连接失败的原因，之后的读写都返回这个错误
+	closed    bool  // 本地调用了Close
+	closedAt  time.Time
+
+	// 发送
+	seq       uint16       // 下一个包的seq_nr
+	outq      []*utpPacket // 已经发出还没有被确认的包，按seq排序
+	inflight  int          // outq中数据的byte数
+	maxWindow float64      // LEDBAT计算出的拥塞窗口
+	peerWnd   int          // 对方接收缓冲区的剩余空间
+	lastAck   uint16
+	dupAcks   int
+	rtt       time.Duration
+	rttVar    time.Duration
+	rto       time.Duration
+	retries   int
+	delay     utpDelay
+
+	// 接收
+	ack        uint16 // 按顺序收到的最后一个包
+	recv       bytes.Buffer
+	ooo        map[uint16]*utpPacket // 乱序到达的包
+	replyMicro uint32                // 最近一次收到包时测得的延迟，放到发出的包中告诉对方
+	eof        bool                  // 收到了FIN，并且FIN之前的包都已经收到
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+type utpPacket struct {
+	typ        uint8
+	seq        uint16
+	payload    []byte
+	sent       time.Time
+	resent     bool // 重传过的包不用于计算RTT
+	fastResent bool
+}
+
+func newUTPConn(s *utpSocket, addr net.Addr, recvId, sendId uint16) *utpConn {
+	return &utpConn{
+		s:         s,
+		addr:      addr,
+		recvId:    recvId,
+		sendId:    sendId,
+		changed:   make(chan struct{}),
+		maxWindow: utpInitWindow,
+		peerWnd:   utpRecvWindow,
+		rto:       utpInitTimeout,
+		ooo:       make(map[uint16]*utpPacket),
+	}
+}
+
+func (c *utpConn) Read(p []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		if c.recv.Len() > 0 {
+			n, _ := c.recv.Read(p)
+			c.mu.Unlock()
+			return n, nil
+		}
+		var err error
+		switch {
+		case c.closed:
+			err = net.ErrClosed
+		case c.eof:
+			err = io.EOF
+		case c.err != nil:
+			err = c.err
+		}
+		changed, deadline := c.changed, c.readDeadline
+		c.mu.Unlock()
+
+		if err != nil {
+			return 0, err
+		}
+		err = waitChange(changed, deadline)
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (c *utpConn) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		c.mu.Lock()
+		var err error
+		switch {
+		case c.closed:
+			err = net.ErrClosed
+		case c.err != nil:
+			err = c.err
+		}
+		if err != nil {
+			c.mu.Unlock()
+			return written, err
+		}
+
+		n := len(p) - written
+		if n > utpMSS {
+			n = utpMSS
+		}
+		window := int(c.maxWindow)
+		if c.peerWnd < window {
+			window = c.peerWnd
+		}
+		// 窗口满了就等待ack，没有数据在路上时总是允许发送一个包，避免窗口太小时卡住
+		if c.inflight > 0 && c.inflight+n > window {
+			changed, deadline := c.changed, c.writeDeadline
+			c.mu.Unlock()
+			err = waitChange(changed, deadline)
+			if err != nil {
+				return written, err
+			}
+			continue
+		}
+		c.send(utpData, p[written:written+n])
+		written += n
+		c.mu.Unlock()
+	}
+	return written, nil
+}
+
+// 发送FIN后立即返回，之后由tickLoop等待FIN被确认
+func (c *utpConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	c.closedAt = time.Now()
+	if c.connected && c.err == nil {
+		c.send(utpFin, nil)
+	} else if c.err == nil {
+		c.err = net.ErrClosed
+	}
+	c.wake()
+	return nil
+}
+
+func (c *utpConn) LocalAddr() net.Addr {
+	return c.s.pc.LocalAddr()
+}
+
+func (c *utpConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+func (c *utpConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	c.writeDeadline = t
+	c.wake()
+	return nil
+}
+
+func (c *utpConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	c.wake()
+	return nil
+}
+
+func (c *utpConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	c.wake()
+	return nil
+}
+
+// 等待changed被关闭，超过deadline时返回和net.Conn相同的超时错误
+func waitChange(changed chan struct{}, deadline time.Time) error {
+	if deadline.IsZero() {
+		<-changed
+		return nil
+	}
+	d := time.Until(deadline)
+	if d <= 0 {
+		return os.ErrDeadlineExceeded
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-changed:
+		return nil
+	case <-timer.C:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+// 以下的方法调用时都需要持有c.mu
+
+func (c *utpConn) wake() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+func (c *utpConn) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.wake()
+}
+
+func (c *utpConn) send(typ uint8, payload []byte) {
+	pkt := &utpPacket{typ: typ, seq: c.seq, payload: append([]byte(nil), payload...)}
+	c.seq++
+	c.outq = append(c.outq, pkt)
+	c.inflight += len(pkt.payload)
+	c.transmit(pkt)
+}
+
+func (c *utpConn) transmit(pkt *utpPacket) {
+	pkt.sent = time.Now()
+	c.s.writeTo(c.header(pkt.typ, pkt.seq).marshal(pkt.payload), c.addr)
+}
+
+// 确认收到的包，STATE不占用序号
+func (c *utpConn) sendState() {
+	c.s.writeTo(c.header(utpState, c.seq).marshal(nil), c.addr)
+}
+
+func (c *utpConn) header(typ uint8, seq uint16) *utpHeader {
+	h := &utpHeader{
+		typ:       typ,
+		connId:    c.sendId,
+		timestamp: utpNow(),
+		timeDiff:  c.replyMicro,
+		wnd:       uint32(c.recvWindow()),
+		seq:       seq,
+		ack:       c.ack,
+		sack:      c.sackMask(),
+	}
+	// SYN中带的是我们的recvId，对方据此计算出两个方向的id
+	if typ == utpSyn {
+		h.connId = c.recvId
+	}
+	return h
+}
+
+func (c *utpConn) recvWindow() int {
+	n := utpRecvWindow - c.recv.Len()
+	for _, pkt := range c.ooo {
+		n -= len(pkt.payload)
+	}
+	if n < 0 {
+		return 0
+	}
+	return n
+}
+
+func (c *utpConn) sackMask() []byte {
+	if len(c.ooo) == 0 {
+		return nil
+	}
+	last := 0
+	for seq := range c.ooo {
+		if i := int(seq - c.ack - 2); i > last {
+			last = i
+		}
+	}
+	// bitmask的长度必须是4的倍数
+	mask := make([]byte, (last/32+1)*4)
+	for seq := range c.ooo {
+		i := int(seq - c.ack - 2)
+		mask[i/8] |= 1 << (i % 8)
+	}
+	return mask
+}
+
+func (c *utpConn) handle(h *utpHeader, payload []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	defer c.wake()
+	c.replyMicro = utpNow() - h.timestamp
+	c.peerWnd = int(h.wnd)
+
+	if h.typ == utpReset {
+		c.err = errUTPReset
+		return
+	}
+	if !c.connected {
+		// 对方对SYN的回复，对方的第一个数据包使用这个seq_nr
+		if h.typ != utpState {
+			return
+		}
+		c.connected = true
+		c.ack = h.seq - 1
+	}
+	c.processAck(h)
+
+	if h.typ == utpData || h.typ == utpFin {
+		c.receive(h.typ, h.seq, payload)
+		c.sendState()
+	}
+}
+
+func (c *utpConn) processAck(h *utpHeader) {
+	now := time.Now()
+	acked, progress := 0, false
+	// ack_nr以及之前的包都已经收到
+	for len(c.outq) > 0 && !seqLess(h.ack, c.outq[0].seq) {
+		acked += c.ackPacket(c.outq[0], now)
+		c.outq = c.outq[1:]
+		progress = true
+	}
+
+	// selective ack中标记的包
+	sacked := 0
+	if len(h.sack) > 0 {
+		for _, b := range h.sack {
+			for ; b != 0; b &= b - 1 {
+				sacked++
+			}
+		}
+		kept := c.outq[:0]
+		for _, pkt := range c.outq {
+			i := int(pkt.seq - h.ack - 2)
+			if i < len(h.sack)*8 && h.sack[i/8]&(1<<(i%8)) != 0 {
+				acked += c.ackPacket(pkt, now)
+				progress = true
+				continue
+			}
+			kept = append(kept, pkt)
+		}
+		c.outq = kept
+	}
+
+	if progress {
+		c.retries = 0
+		c.dupAcks = 0
+		c.updateWindow(acked, h.timeDiff)
+	} else if h.typ == utpState && len(c.outq) > 0 && h.ack == c.lastAck {
+		c.dupAcks++
+	}
+	c.lastAck = h.ack
+
+	// 之后的包已经收到了三个，或者收到三个重复的ack，认为第一个包丢了，不等超时立即重传
+	if len(c.outq) > 0 && (sacked >= 3 || c.dupAcks >= 3) && !c.outq[0].fastResent {
+		pkt := c.outq[0]
+		pkt.fastResent = true
+		pkt.resent = true
+		c.transmit(pkt)
+		c.maxWindow /= 2
+		if c.maxWindow < utpMinWindow {
+			c.maxWindow = utpMinWindow
+		}
+	}
+}
+
+func (c *utpConn) ackPacket(pkt *utpPacket, now time.Time) int {
+	if !pkt.resent {
+		c.updateRTT(now.Sub(pkt.sent))
+	}
+	c.inflight -= len(pkt.payload)
+	return len(pkt.payload)
+}
+
+func (c *utpConn) updateRTT(sample time.Duration) {
+	if c.rtt == 0 {
+		c.rtt = sample
+		c.rttVar = sample / 2
+	} else {
+		diff := c.rtt - sample
+		if diff < 0 {
+			diff = -diff
+		}
+		c.rttVar += (diff - c.rttVar) / 4
+		c.rtt += (sample - c.rtt) / 8
+	}
+	c.rto = c.rtt + 4*c.rttVar
+	if c.rto < utpMinTimeout {
+		c.rto = utpMinTimeout
+	}
+}
+
+// LEDBAT：排队延迟低于目标值时增大窗口，高于目标值时减小窗口
+// 对方测得的延迟包含了两边时钟的差，减去最近的最小值之后才是排队的延迟
+func (c *utpConn) updateWindow(acked int, delay uint32) {
+	if delay == 0 || acked == 0 {
+		return
+	}
+	base := c.delay.update(delay, time.Now())
+	queuing := float64(delay - base)
+	offTarget := (utpTarget - queuing) / utpTarget
+	c.maxWindow += utpMaxGain * offTarget * float64(acked) / c.maxWindow
+	if c.maxWindow < utpMinWindow {
+		c.maxWindow = utpMinWindow
+	}
+	if c.maxWindow > utpRecvWindow {
+		c.maxWindow = utpRecvWindow
+	}
+}
+
+func (c *utpConn) receive(typ uint8, seq uint16, payload []byte) {
+	if c.eof {
+		return
+	}
+	// 重复的包或者超出缓存范围的包直接丢弃，对方会重传
+	d := seq - c.ack
+	if d == 0 || d > utpMaxOOO {
+		return
+	}
+	if d > 1 {
+		c.ooo[seq] = &utpPacket{typ: typ, seq: seq, payload: payload}
+		return
+	}
+	c.deliver(typ, payload)
+	for !c.eof {
+		pkt, ok := c.ooo[c.ack+1]
+		if !ok {
+			break
+		}
+		delete(c.ooo, pkt.seq)
+		c.deliver(pkt.typ, pkt.payload)
+	}
+}
+
+func (c *utpConn) deliver(typ uint8, payload []byte) {
+	c.ack++
+	if typ == utpFin {
+		c.eof = true
+		c.ooo = make(map[uint16]*utpPacket)
+		return
+	}
+	c.recv.Write(payload)
+}
+
+// 定时检查重传，连接结束时从socket中移除
+func (c *utpConn) tickLoop() {
+	ticker := time.NewTicker(utpTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.s.done:
+			return
+		}
+		if c.tick() {
+			c.s.remove(c)
+			return
+		}
+	}
+}
+
+// 返回true表示连接已经结束
+func (c *utpConn) tick() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return true
+	}
+	if c.closed && (len(c.outq) == 0 || time.Since(c.closedAt) > utpLinger) {
+		return true
+	}
+	if len(c.outq) == 0 || time.Since(c.outq[0].sent) < c.rto {
+		return false
+	}
+
+	c.retries++
+	if c.retries > utpMaxRetries {
+		c.err = errUTPTimeout
+		c.wake()
+		return true
+	}
+	// 超时说明网络很拥挤，窗口减到最小
+	c.rto *= 2
+	if c.rto > utpMaxTimeout {
+		c.rto = utpMaxTimeout
+	}
+	c.maxWindow = utpMinWindow
+	pkt := c.outq[0]
+	pkt.resent = true
+	c.transmit(pkt)
+	return false
+}
+
+// 最近两分钟内测得的最小延迟，作为没有排队时的基准
+type utpDelay struct {
+	cur   uint32 // 当前这一分钟的最小值
+	prev  uint32 // 上一分钟的最小值
+	start time.Time
+}
+
+func (d *utpDelay) update(sample uint32, now time.Time) uint32 {
+	if d.start.IsZero() {
+		d.cur, d.prev, d.start = sample, sample, now
+	}
+	if now.Sub(d.start) > utpDelayWindow {
+		d.prev, d.cur, d.start = d.cur, sample, now
+	}
+	if int32(sample-d.cur) < 0 {
+		d.cur = sample
+	}
+	if int32(d.prev-d.cur) < 0 {
+		return d.prev
+	}
+	return d.cur
+}
@@ -0,0 +1,160 @@
+package torrent
+
+import (
+	"context"
+	"crypto/rand"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 每n个包丢掉一个
+type lossyPacketConn struct {
+	net.PacketConn
+	n     int64
+	count atomic.Int64
+}
+
+func (c *lossyPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if c.count.Add(1)%c.n == 0 {
+		return len(b), nil
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+func newTestUTPSocket(t *testing.T, lossEvery int64) *utpSocket {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	if lossEvery > 0 {
+		pc = &lossyPacketConn{PacketConn: pc, n: lossEvery}
+	}
+	s := &utpSocket{
+		pc:     pc,
+		conns:  make(map[utpKey]*utpConn),
+		accept: make(chan *utpConn, utpBacklog),
+		done:   make(chan struct{}),
+	}
+	go s.readLoop()
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestUTPHeader(t *testing.T) {
+	h := &utpHeader{typ: utpData, connId: 7, timestamp: 1, timeDiff: 2, wnd: 3, seq: 4, ack: 5, sack: []byte{1, 0, 0, 0}}
+	got, payload, err := parseUTPPacket(h.marshal([]byte("data")))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, h, got)
+	assert.Equal(t, []byte("data"), payload)
+
+	_, _, err = parseUTPPacket([]byte("d1:ad2:id20:abcdefghij0123456789e1:q4:ping1:t2:aa1:y1:qe"))
+	assert.NotEqual(t, nil, err)
+}
+
+func TestUTPConn(t *testing.T) {
+	ls := newTestUTPSocket(t, 0)
+	ds := newTestUTPSocket(t, 0)
+
+	data := make([]byte, 512*1024)
+	rand.Read(data)
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := ls.Accept()
+		accepted <- c
+	}()
+	a, err := ds.dial(context.Background(), ls.Addr())
+	assert.Equal(t, nil, err)
+	b := <-accepted
+
+	go func() {
+		a.Write(data)
+		a.Close()
+	}()
+	b.SetReadDeadline(time.Now().Add(20 * time.Second))
+	got, err := io.ReadAll(b)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, data, got)
+
+	// 本地关闭之后读取返回ErrClosed
+	b.Close()
+	_, err = b.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, net.ErrClosed)
+
+	// 超时返回和net.Conn相同的错误
+	c, err := ds.dial(context.Background(), ls.Addr())
+	assert.Equal(t, nil, err)
+	c.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err = c.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	assert.True(t, isTimeout(err))
+}
+
+func TestUTPLoss(t *testing.T) {
+	// 两个方向都有丢包，靠selective ack和超时重传恢复
+	ls := newTestUTPSocket(t, 7)
+	ds := newTestUTPSocket(t, 11)
+
+	data := make([]byte, 256*1024)
+	rand.Read(data)
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := ls.Accept()
+		accepted <- c
+	}()
+	a, err := ds.dial(context.Background(), ls.Addr())
+	assert.Equal(t, nil, err)
+	b := <-accepted
+
+	go func() {
+		a.Write(data)
+		a.Close()
+	}()
+	b.SetReadDeadline(time.Now().Add(30 * time.Second))
+	got, err := io.ReadAll(b)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, data, got)
+}
+
+func TestUTPDialRefused(t *testing.T) {
+	// 没有监听的UDP端口，单独的socket会收到ICMP错误，不用等到超时
+	pc, _ := net.ListenPacket("udp", "127.0.0.1:0")
+	addr := pc.LocalAddr().String()
+	pc.Close()
+
+	start := time.Now()
+	_, err := dialUTP(context.Background(), addr, nil)
+	assert.NotEqual(t, nil, err)
+	assert.Less(t, time.Since(start), utpDialTimeout)
+}
+
+func TestDownloadUTP(t *testing.T) {
+	data := []byte("0123456789")
+	// 只监听uTP，下载时先尝试uTP
+	ls := newTestUTPSocket(t, 0)
+	go func() {
+		for {
+			conn, err := ls.Accept()
+			if err != nil {
+				return
+			}
+			hs, err := ReadHandshake(conn)
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			id, _ := NewPeerID("-TS0001-")
+			WriteHandShake(conn, NewHandShakeMsg(hs.InfoSHA, id))
+			go serveSeeder(conn, data, len(data))
+		}
+	}()
+
+	addr := ls.Addr().(*net.UDPAddr)
+	task := newTestTask(t, []PeerInfo{{Ip: addr.IP, Port: uint16(addr.Port)}})
+	assert.Equal(t, nil, Download(context.Background(), task))
+	got, _ := os.ReadFile(task.FileName)
+	assert.Equal(t, data, got)
+}